@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+func handleCache(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage : cache <config|list|clear|warm>")
+		return
+	}
+
+	switch args[0] {
+	case "config":
+		if len(args) < 2 {
+			fmt.Println("Usage : cache config <database> [enabled on|off | ttl <durée> | max_entries <n> | max_bytes <taille>]")
+			return
+		}
+		if len(args) >= 4 {
+			if err := database.SetCacheOption(args[1], args[2], args[3]); err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			fmt.Printf("Option \"%s\" du cache mise à jour.\n", args[2])
+		}
+		config, err := database.GetCacheConfig(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		status := "activé"
+		if !config.Enabled {
+			status = "désactivé"
+		}
+		ttl := config.TTL.String()
+		if config.TTL == 0 {
+			ttl = "sans expiration"
+		}
+		fmt.Printf("Cache %s\n", status)
+		fmt.Printf("• Durée de vie : %s\n", ttl)
+		fmt.Printf("• Entrées max : %d\n", config.MaxEntries)
+		fmt.Printf("• Taille max : %.2f KB\n", float64(config.MaxBytes)/1024)
+	case "list":
+		if len(args) < 2 {
+			fmt.Println("Usage : cache list <database>")
+			return
+		}
+		entries, err := database.ListCacheEntries(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(entries) == 0 {
+			fmt.Println("Le cache est vide.")
+			return
+		}
+		for _, entry := range entries {
+			where := []string{}
+			for field, value := range entry.Where {
+				where = append(where, field+"="+value)
+			}
+			fmt.Printf("• %s [%s] : %d lignes, %.2f KB, utilisé le %s", entry.Table, strings.Join(where, " "), entry.Rows, float64(entry.Size)/1024, entry.LastUsed.Format("02/01/2006 15:04:05"))
+			if !entry.ExpiresAt.IsZero() {
+				fmt.Printf(", expire le %s", entry.ExpiresAt.Format("02/01/2006 15:04:05"))
+			}
+			fmt.Println()
+		}
+	case "clear":
+		if len(args) < 2 {
+			fmt.Println("Usage : cache clear <database> [table]")
+			return
+		}
+		table := ""
+		if len(args) > 2 {
+			table = args[2]
+		}
+		removed, err := database.ClearCache(args[1], table)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("%d entrée(s) supprimée(s) du cache.\n", removed)
+	case "warm":
+		if len(args) < 3 {
+			fmt.Println("Usage : cache warm <database> <table> [field=value ...]")
+			return
+		}
+		where := map[string]string{}
+		for _, arg := range args[3:] {
+			if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+				where[parts[0]] = parts[1]
+			}
+		}
+		count, err := database.WarmCache(args[1], args[2], where)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Sélection mise en cache (%d lignes).\n", count)
+	default:
+		fmt.Printf("Commande inconnue : %s\n", args[0])
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"github.com/fabian222222/lib-db/pkg/database"
 )
 
 func handleData(args []string) {
 	if len(args) < 1 {
-		fmt.Println("Usage : data <insert|update|delete|select|cache> <database> <table> <field1=value1 field2=value2 ...>")
+		fmt.Println("Usage : data <insert|update|upsert|delete|restore|purge|expire|vacuum|select|history|search|aggregate|cache> <database> <table> <field1=value1 field2=value2 ...>")
 		return
 	}
 
@@ -33,57 +38,345 @@ func handleData(args []string) {
 			fmt.Println("Erreur :", err)
 		}
 	case "update":
+		if len(args) > 3 && args[3] == "--where" {
+			handleBulkData(args)
+			return
+		}
 		if len(args) < 4 {
-			fmt.Println("Usage : data update <database> <table> <id> <field1=value1 field2=value2 ...>")
+			fmt.Println("Usage : data update <database> <table> <id> [--expect-version n] <field1=value1 field2=value2 ...>")
 			return
 		}
 		var input map[string]string = map[string]string{}
+		var version int64
 		if len(args) > 2 {
 			for i := 2; i < len(args); i++ {
-				pair := args[i]
-				if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
-					input[parts[0]] = parts[1]
+				if args[i] == "--expect-version" && i+1 < len(args) {
+					i++
+					v, err := parseExpectedVersion(args[i])
+					if err != nil {
+						fmt.Println("Erreur :", err)
+						return
+					}
+					version = v
+					continue
+				}
+				if field, expr, ok := database.ParseAssignment(args[i]); ok {
+					input[field] = expr
 				}
 			}
 		}
-		err := database.UpdateData(args[1], args[2], args[3], input)
+		err := database.UpdateDataIfVersion(args[1], args[2], args[3], version, input)
 		if err != nil {
 			fmt.Println("Erreur :", err)
 		}
 	case "delete":
+		if len(args) > 3 && args[3] == "--where" {
+			handleBulkData(args)
+			return
+		}
 		if len(args) < 4 {
-			fmt.Println("Usage : data delete <database> <table> <id>")
+			fmt.Println("Usage : data delete <database> <table> <id> [--expect-version n]")
 			return
 		}
-		err := database.DeleteData(args[1], args[2], args[3])
+		var version int64
+		if len(args) > 5 && args[4] == "--expect-version" {
+			v, err := parseExpectedVersion(args[5])
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			version = v
+		}
+		err := database.DeleteDataIfVersion(args[1], args[2], args[3], version)
 		if err != nil {
 			fmt.Println("Erreur :", err)
 		}
 	case "select":
 		if len(args) < 3 {
-			fmt.Println("Usage : data select <database> <table> [field=value ...]")
+			fmt.Println("Usage : data select <database> <table> [field=value field>value ...] [--explain] [--analyze] [--as-of \"AAAA-MM-JJ HH:MM:SS\"] [--include-deleted]")
 			return
 		}
-		databaseName := args[1]
-		tableName := args[2]
+		query := database.Query{
+			DBName: args[1],
+			Table:  args[2],
+		}
 		filters := make(map[string]string)
-		for _, pair := range args[3:] {
-			if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
-				filters[parts[0]] = parts[1]
+		explain, analyze := false, false
+		asOf := ""
+		for i := 3; i < len(args); i++ {
+			arg := args[i]
+			switch {
+			case arg == "--explain":
+				explain = true
+				continue
+			case arg == "--analyze":
+				explain, analyze = true, true
+				continue
+			case arg == "--as-of" && i+1 < len(args):
+				i++
+				asOf = args[i]
+				continue
+			case arg == "--include-deleted":
+				query.IncludeDeleted = true
+				continue
+			}
+			cond, err := database.ParseCondition(arg)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			query.Conditions = append(query.Conditions, cond)
+			if cond.Op == "=" {
+				filters[cond.Field] = cond.Value
+			}
+		}
+
+		if asOf != "" {
+			at, err := database.ParseTimestamp(asOf)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			results, err := database.SelectAsOf(query, at)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
 			}
+			if len(results) == 0 {
+				fmt.Println("Aucune donnée trouvée.")
+				return
+			}
+			for _, entry := range results {
+				fmt.Println(entry)
+			}
+			return
 		}
 
-		results, err := database.SelectData(databaseName, tableName, filters)
+		if explain {
+			plan, err := database.ExplainQuery(query, analyze)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			fmt.Print(plan)
+			return
+		}
+
+		// Ctrl+C interrompt le parcours proprement au lieu de tuer le processus.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		var rows *database.Rows
+		var err error
+		if len(filters) == len(query.Conditions) && !query.IncludeDeleted {
+			rows, err = database.SelectDataRows(ctx, query.DBName, query.Table, filters)
+		} else {
+			rows, err = database.QueryRows(ctx, query)
+		}
 		if err != nil {
 			fmt.Println("Erreur :", err)
 			return
 		}
+		defer rows.Close()
+		if rows.FromCache() {
+			fmt.Println("Résultat récupéré depuis le cache.")
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		count := 0
+		for rows.Next() {
+			fmt.Fprintln(out, rows.Row())
+			count++
+		}
+		out.Flush()
+		if err := rows.Err(); err != nil {
+			fmt.Printf("Erreur après %d ligne(s) : %v\n", count, err)
+			return
+		}
 
+		if count == 0 {
+			fmt.Println("Aucune donnée trouvée.")
+		}
+	case "upsert":
+		if len(args) < 4 {
+			fmt.Println("Usage : data upsert <database> <table> [--on f1,f2] [--do-nothing | --update f1,f2] <field1=value1 field2=value2 ...>")
+			return
+		}
+		var opts database.UpsertOptions
+		row := map[string]string{}
+		for i := 3; i < len(args); i++ {
+			switch {
+			case args[i] == "--on" && i+1 < len(args):
+				i++
+				opts.ConflictFields = strings.Split(args[i], ",")
+			case args[i] == "--update" && i+1 < len(args):
+				i++
+				opts.UpdateColumns = strings.Split(args[i], ",")
+			case args[i] == "--do-nothing":
+				opts.DoNothing = true
+			default:
+				if field, expr, ok := database.ParseAssignment(args[i]); ok {
+					row[field] = expr
+				}
+			}
+		}
+		action, id, err := database.UpsertData(args[1], args[2], row, opts)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		switch action {
+		case "inserted":
+			fmt.Printf("Entrée \"%s\" insérée.\n", id)
+		case "updated":
+			fmt.Printf("Entrée \"%s\" mise à jour.\n", id)
+		default:
+			fmt.Printf("Entrée \"%s\" déjà existante, rien n'a été modifié.\n", id)
+		}
+	case "restore":
+		if len(args) < 4 {
+			fmt.Println("Usage : data restore <database> <table> <id>")
+			return
+		}
+		if err := database.RestoreData(args[1], args[2], args[3]); err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Entrée avec l'id \"%s\" restaurée.\n", args[3])
+	case "purge":
+		if len(args) < 3 {
+			fmt.Println("Usage : data purge <database> <table> [--older-than 30d]")
+			return
+		}
+		retention, err := database.TableRetention(args[1], args[2])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(args) > 4 && args[3] == "--older-than" {
+			retention, err = database.ParseRetention(args[4])
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+		}
+		ids, err := database.PurgeDeleted(args[1], args[2], retention)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("%d ligne(s) supprimée(s) définitivement.\n", len(ids))
+	case "expire":
+		if len(args) < 3 {
+			fmt.Println("Usage : data expire <database> <table>")
+			return
+		}
+		ids, err := database.ExpireRows(args[1], args[2])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("%d ligne(s) expirée(s) supprimée(s).\n", len(ids))
+	case "vacuum":
+		if len(args) < 2 {
+			fmt.Println("Usage : data vacuum <database>")
+			return
+		}
+		n, err := database.Vacuum(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("%d ancienne(s) version(s) supprimée(s).\n", n)
+	case "history":
+		if len(args) < 4 {
+			fmt.Println("Usage : data history <database> <table> <id>")
+			return
+		}
+		versions, err := database.RowHistory(args[1], args[2], args[3])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(versions) == 0 {
+			fmt.Println("Aucune version enregistrée.")
+			return
+		}
+		for _, version := range versions {
+			user := version.User
+			if user == "" {
+				user = "-"
+			}
+			if version.Data == nil {
+				fmt.Printf("%s  %-8s %-10s -\n", version.Timestamp.Format("2006-01-02 15:04:05"), version.Op, user)
+				continue
+			}
+			fmt.Printf("%s  %-8s %-10s %v\n", version.Timestamp.Format("2006-01-02 15:04:05"), version.Op, user, version.Data)
+		}
+	case "search":
+		if len(args) < 5 {
+			fmt.Println("Usage : data search <database> <table> <field> \"<terms>\"")
+			return
+		}
+		results, err := database.SearchData(args[1], args[2], args[3], strings.Join(args[4:], " "))
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
 		if len(results) == 0 {
 			fmt.Println("Aucune donnée trouvée.")
 			return
 		}
+		for _, result := range results {
+			fmt.Printf("[%.3f] %v\n", result.Score, result.Row)
+		}
+	case "aggregate":
+		if len(args) < 4 {
+			fmt.Println("Usage : data aggregate <database> <table> [field=value ...] [--group-by f1,f2] [--having \"sum(f)>n\"] <count(*)|sum(f)|avg(f)|min(f)|max(f) ...>")
+			return
+		}
+		query := database.AggregateQuery{
+			DBName: args[1],
+			Table:  args[2],
+			Where:  map[string]string{},
+		}
+		for i := 3; i < len(args); i++ {
+			arg := args[i]
+			switch {
+			case arg == "--group-by" && i+1 < len(args):
+				i++
+				query.GroupBy = strings.Split(args[i], ",")
+			case arg == "--having" && i+1 < len(args):
+				i++
+				having, err := database.ParseHaving(args[i])
+				if err != nil {
+					fmt.Println("Erreur :", err)
+					return
+				}
+				query.Having = append(query.Having, having)
+			case strings.Contains(arg, "("):
+				agg, err := database.ParseAggregate(arg)
+				if err != nil {
+					fmt.Println("Erreur :", err)
+					return
+				}
+				query.Aggregates = append(query.Aggregates, agg)
+			default:
+				if parts := strings.SplitN(arg, "=", 2); len(parts) == 2 {
+					query.Where[parts[0]] = parts[1]
+				}
+			}
+		}
 
+		results, err := database.AggregateData(query)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(results) == 0 {
+			fmt.Println("Aucune donnée trouvée.")
+			return
+		}
 		for _, entry := range results {
 			fmt.Println(entry)
 		}
@@ -97,3 +390,78 @@ func handleData(args []string) {
 		fmt.Println("Action non reconnue.")
 	}
 }
+
+// parseExpectedVersion lit la valeur de --expect-version (_version d'une
+// ligne, à partir de 1).
+func parseExpectedVersion(value string) (int64, error) {
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("version invalide : \"%s\"", value)
+	}
+	return version, nil
+}
+
+func handleBulkData(args []string) {
+	action := args[0]
+	var conditions []database.Condition
+	updates := map[string]string{}
+	dryRun := false
+	all := false
+	inSet := false
+	for _, arg := range args[4:] {
+		switch {
+		case arg == "--dry-run":
+			dryRun = true
+		case arg == "--all":
+			all = true
+		case arg == "set" && action == "update":
+			inSet = true
+		case inSet:
+			field, expr, ok := database.ParseAssignment(arg)
+			if !ok {
+				fmt.Printf("Erreur : affectation invalide : \"%s\" (format attendu : champ=valeur)\n", arg)
+				return
+			}
+			updates[field] = expr
+		default:
+			cond, err := database.ParseCondition(arg)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			conditions = append(conditions, cond)
+		}
+	}
+
+	// Sans condition, toutes les lignes seraient touchées : il faut le
+	// demander explicitement.
+	if len(conditions) == 0 && !all {
+		fmt.Println("Erreur : aucune condition ; ajoutez --all pour traiter toutes les lignes de la table")
+		return
+	}
+
+	var ids []string
+	var err error
+	if action == "update" {
+		if len(updates) == 0 {
+			fmt.Println("Usage : data update <database> <table> --where <field=value ...> [--all] set <field=value ...> [--dry-run]")
+			return
+		}
+		ids, err = database.UpdateWhere(args[1], args[2], conditions, updates, dryRun)
+	} else {
+		ids, err = database.DeleteWhere(args[1], args[2], conditions, dryRun)
+	}
+	if err != nil {
+		fmt.Println("Erreur :", err)
+		return
+	}
+
+	if dryRun {
+		fmt.Printf("%d ligne(s) seraient affectée(s) :\n", len(ids))
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return
+	}
+	fmt.Printf("%d ligne(s) affectée(s).\n", len(ids))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+func handleIndex(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage : index <create|drop|list|rebuild>")
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 4 {
+			fmt.Println("Usage : index create <database> <table> <field> [hash|btree|fulltext] [--stem]")
+			return
+		}
+		kind := "hash"
+		if len(args) > 4 {
+			kind = args[4]
+		}
+		var err error
+		if kind == "fulltext" {
+			err = database.CreateFullTextIndex(args[1], args[2], args[3], len(args) > 5 && args[5] == "--stem")
+		} else {
+			err = database.CreateIndex(args[1], args[2], args[3], kind)
+		}
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Index %s créé sur %s.%s\n", kind, args[2], args[3])
+	case "drop":
+		if len(args) < 4 {
+			fmt.Println("Usage : index drop <database> <table> <field>")
+			return
+		}
+		err := database.DropIndex(args[1], args[2], args[3])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Index supprimé sur %s.%s\n", args[2], args[3])
+	case "list":
+		if len(args) < 2 {
+			fmt.Println("Usage : index list <database>")
+			return
+		}
+		indexes, err := database.ListIndexes(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(indexes) == 0 {
+			fmt.Println("Aucun index.")
+			return
+		}
+		for _, idx := range indexes {
+			fmt.Printf("• %s.%s (%s) : %d valeurs distinctes\n", idx.Table, idx.Field, idx.Kind, idx.Size())
+		}
+	case "rebuild":
+		if len(args) < 2 {
+			fmt.Println("Usage : index rebuild <database> [table]")
+			return
+		}
+		var tableName string
+		if len(args) > 2 {
+			tableName = args[2]
+		}
+		err := database.RebuildIndexes(args[1], tableName)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Println("Index reconstruits.")
+	default:
+		fmt.Printf("Commande inconnue : %s\n", args[0])
+	}
+}
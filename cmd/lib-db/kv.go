@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+func handleKV(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage : kv <get|set|del|exists|incr|incrby|decr|decrby|mget|mset|expire|ttl|persist|keys|type|hset|hget|hgetall|lpush|rpush|lpop|rpop|lrange|sadd|srem|smembers|sinter|zadd|zrange|zrangebyscore|config|save> <database> <key> [...]")
+		return
+	}
+
+	action, dbName := strings.ToLower(args[0]), args[1]
+	args = args[2:]
+	// En mode snapshot, les modifications sont enregistrées en différé : le
+	// processus les écrit avant de se terminer.
+	defer func() {
+		if err := database.KVFlush(dbName); err != nil {
+			fmt.Println("Erreur :", err)
+		}
+	}()
+	switch action {
+	case "get":
+		if len(args) != 1 {
+			fmt.Println("Usage : kv get <database> <key>")
+			return
+		}
+		value, ok, err := database.KVGet(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if !ok {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Printf("%q\n", value)
+	case "set":
+		if len(args) < 2 {
+			fmt.Println("Usage : kv set <database> <key> <value> [ex <secondes> | px <millisecondes>] [nx|xx]")
+			return
+		}
+		options := database.KVSetOptions{}
+		for i := 2; i < len(args); i++ {
+			switch strings.ToLower(args[i]) {
+			case "nx":
+				options.NX = true
+			case "xx":
+				options.XX = true
+			case "ex", "px":
+				if i+1 >= len(args) {
+					fmt.Printf("Erreur : durée manquante après %s\n", args[i])
+					return
+				}
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || n <= 0 {
+					fmt.Printf("Erreur : durée invalide : \"%s\"\n", args[i+1])
+					return
+				}
+				options.TTL = time.Duration(n) * time.Second
+				if strings.ToLower(args[i]) == "px" {
+					options.TTL = time.Duration(n) * time.Millisecond
+				}
+				i++
+			default:
+				fmt.Printf("Erreur : option inconnue : %s\n", args[i])
+				return
+			}
+		}
+		set, err := database.KVSet(dbName, args[0], args[1], options)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if !set {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Println("OK")
+	case "del", "exists":
+		if len(args) < 1 {
+			fmt.Printf("Usage : kv %s <database> <key> [key ...]\n", action)
+			return
+		}
+		var n int
+		var err error
+		if action == "del" {
+			n, err = database.KVDel(dbName, args...)
+		} else {
+			n, err = database.KVExists(dbName, args...)
+		}
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", n)
+	case "incr", "decr", "incrby", "decrby":
+		delta := int64(1)
+		if strings.HasSuffix(action, "by") {
+			if len(args) != 2 {
+				fmt.Printf("Usage : kv %s <database> <key> <n>\n", action)
+				return
+			}
+			n, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				fmt.Printf("Erreur : \"%s\" n'est pas un entier\n", args[1])
+				return
+			}
+			delta = n
+		} else if len(args) != 1 {
+			fmt.Printf("Usage : kv %s <database> <key>\n", action)
+			return
+		}
+		if strings.HasPrefix(action, "decr") {
+			delta = -delta
+		}
+		value, err := database.KVIncrBy(dbName, args[0], delta)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", value)
+	case "mget":
+		if len(args) < 1 {
+			fmt.Println("Usage : kv mget <database> <key> [key ...]")
+			return
+		}
+		values, err := database.KVMGet(dbName, args...)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		for i, value := range values {
+			if value == nil {
+				fmt.Printf("%d) (nil)\n", i+1)
+			} else {
+				fmt.Printf("%d) %q\n", i+1, *value)
+			}
+		}
+	case "mset":
+		if len(args) < 2 || len(args)%2 != 0 {
+			fmt.Println("Usage : kv mset <database> <key> <value> [key value ...]")
+			return
+		}
+		pairs := map[string]string{}
+		for i := 0; i < len(args); i += 2 {
+			pairs[args[i]] = args[i+1]
+		}
+		if err := database.KVMSet(dbName, pairs); err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Println("OK")
+	case "expire":
+		if len(args) != 2 {
+			fmt.Println("Usage : kv expire <database> <key> <secondes>")
+			return
+		}
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			fmt.Printf("Erreur : \"%s\" n'est pas un entier\n", args[1])
+			return
+		}
+		ok, err := database.KVExpire(dbName, args[0], time.Duration(seconds)*time.Second)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", boolToInt(ok))
+	case "ttl":
+		if len(args) != 1 {
+			fmt.Println("Usage : kv ttl <database> <key>")
+			return
+		}
+		ttl, err := database.KVTTL(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if ttl < 0 {
+			fmt.Printf("(integer) %d\n", int64(ttl))
+			return
+		}
+		fmt.Printf("(integer) %d\n", int64((ttl+time.Second/2)/time.Second))
+	case "persist":
+		if len(args) != 1 {
+			fmt.Println("Usage : kv persist <database> <key>")
+			return
+		}
+		ok, err := database.KVPersist(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", boolToInt(ok))
+	case "keys":
+		pattern := "*"
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		keys, err := database.KVKeys(dbName, pattern)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		printKVList(keys)
+	case "type":
+		if len(args) != 1 {
+			fmt.Println("Usage : kv type <database> <key>")
+			return
+		}
+		kind, err := database.KVType(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Println(kind)
+	case "hset":
+		if len(args) < 3 || len(args)%2 != 1 {
+			fmt.Println("Usage : kv hset <database> <key> <field> <value> [field value ...]")
+			return
+		}
+		fields := map[string]string{}
+		for i := 1; i < len(args); i += 2 {
+			fields[args[i]] = args[i+1]
+		}
+		added, err := database.KVHSet(dbName, args[0], fields)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", added)
+	case "hget":
+		if len(args) != 2 {
+			fmt.Println("Usage : kv hget <database> <key> <field>")
+			return
+		}
+		value, ok, err := database.KVHGet(dbName, args[0], args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if !ok {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Printf("%q\n", value)
+	case "hgetall":
+		if len(args) != 1 {
+			fmt.Println("Usage : kv hgetall <database> <key>")
+			return
+		}
+		fields, err := database.KVHGetAll(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		names := make([]string, 0, len(fields))
+		for field := range fields {
+			names = append(names, field)
+		}
+		sort.Strings(names)
+		items := []string{}
+		for _, field := range names {
+			items = append(items, field, fields[field])
+		}
+		printKVList(items)
+	case "lpush", "rpush":
+		if len(args) < 2 {
+			fmt.Printf("Usage : kv %s <database> <key> <value> [value ...]\n", action)
+			return
+		}
+		push := database.KVRPush
+		if action == "lpush" {
+			push = database.KVLPush
+		}
+		length, err := push(dbName, args[0], args[1:]...)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", length)
+	case "lpop", "rpop":
+		if len(args) != 1 {
+			fmt.Printf("Usage : kv %s <database> <key>\n", action)
+			return
+		}
+		pop := database.KVRPop
+		if action == "lpop" {
+			pop = database.KVLPop
+		}
+		value, ok, err := pop(dbName, args[0])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if !ok {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Printf("%q\n", value)
+	case "lrange", "zrange":
+		if len(args) < 3 {
+			fmt.Printf("Usage : kv %s <database> <key> <start> <stop>\n", action)
+			return
+		}
+		start, err1 := strconv.Atoi(args[1])
+		stop, err2 := strconv.Atoi(args[2])
+		if err1 != nil || err2 != nil {
+			fmt.Println("Erreur : les indices doivent être des entiers")
+			return
+		}
+		if action == "lrange" {
+			values, err := database.KVLRange(dbName, args[0], start, stop)
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			printKVList(values)
+			return
+		}
+		members, err := database.KVZRange(dbName, args[0], start, stop)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		printZMembers(members, len(args) > 3 && strings.ToLower(args[3]) == "withscores")
+	case "sadd", "srem":
+		if len(args) < 2 {
+			fmt.Printf("Usage : kv %s <database> <key> <member> [member ...]\n", action)
+			return
+		}
+		update := database.KVSRem
+		if action == "sadd" {
+			update = database.KVSAdd
+		}
+		n, err := update(dbName, args[0], args[1:]...)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", n)
+	case "smembers", "sinter":
+		if len(args) < 1 || (action == "smembers" && len(args) != 1) {
+			fmt.Printf("Usage : kv %s <database> <key> [key ...]\n", action)
+			return
+		}
+		members, err := database.KVSInter(dbName, args...)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		printKVList(members)
+	case "zadd":
+		if len(args) < 3 || len(args)%2 != 1 {
+			fmt.Println("Usage : kv zadd <database> <key> <score> <member> [score member ...]")
+			return
+		}
+		members := []database.ZMember{}
+		for i := 1; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			members = append(members, database.ZMember{Member: args[i+1], Score: score})
+		}
+		added, err := database.KVZAdd(dbName, args[0], members...)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("(integer) %d\n", added)
+	case "zrangebyscore":
+		if len(args) < 3 {
+			fmt.Println("Usage : kv zrangebyscore <database> <key> <min> <max> [withscores]")
+			return
+		}
+		min, err := parseScore(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		max, err := parseScore(args[2])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		members, err := database.KVZRangeByScore(dbName, args[0], min, max)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		printZMembers(members, len(args) > 3 && strings.ToLower(args[3]) == "withscores")
+	case "config":
+		if len(args) >= 2 {
+			if err := database.SetKVOption(dbName, args[0], args[1]); err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+			fmt.Printf("Option \"%s\" du stockage clé-valeur mise à jour.\n", args[0])
+		} else if len(args) == 1 {
+			fmt.Println("Usage : kv config <database> [persistence snapshot|aof | fsync always|everysec|no | auto_rewrite <taille>]")
+			return
+		}
+		config, err := database.GetKVConfig(dbName)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Persistance : %s (fsync %s)\n", config.Persistence, config.Fsync)
+		if config.AutoRewrite > 0 {
+			fmt.Printf("• Réécriture automatique du journal au-delà de %.2f KB\n", float64(config.AutoRewrite)/1024)
+		} else {
+			fmt.Println("• Réécriture automatique du journal désactivée")
+		}
+		for _, file := range []string{"kv.json", "kv.aof"} {
+			if info, err := os.Stat(filepath.Join("../../databases", dbName, file)); err == nil {
+				fmt.Printf("• %s : %.2f KB\n", file, float64(info.Size())/1024)
+			}
+		}
+		if lastSave, err := database.KVLastSave(dbName); err == nil && !lastSave.IsZero() {
+			fmt.Printf("• Dernier enregistrement de kv.json : %s\n", lastSave.Format("02/01/2006 15:04:05"))
+		}
+	case "save":
+		if err := database.KVSave(dbName); err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Println("OK")
+	default:
+		fmt.Printf("Commande inconnue : %s\n", action)
+	}
+}
+
+func printKVList(items []string) {
+	if len(items) == 0 {
+		fmt.Println("(empty array)")
+		return
+	}
+	for i, item := range items {
+		fmt.Printf("%d) %q\n", i+1, item)
+	}
+}
+
+func printZMembers(members []database.ZMember, withScores bool) {
+	items := []string{}
+	for _, m := range members {
+		items = append(items, m.Member)
+		if withScores {
+			items = append(items, strconv.FormatFloat(m.Score, 'g', -1, 64))
+		}
+	}
+	printKVList(items)
+}
+
+// parseScore lit un score d'ensemble trié ; -inf et +inf sont acceptés.
+func parseScore(value string) (float64, error) {
+	score, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("score invalide : \"%s\"", value)
+	}
+	return score, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
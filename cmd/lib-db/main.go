@@ -7,7 +7,7 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Println("Commande requise : login, logout, whoami, user, db, table, field, data, backup, restore, stats")
+		fmt.Println("Commande requise : login, logout, whoami, user, db, table, field, data, tx, index, view, cache, kv, pubsub, serve-redis, backup, restore, stats")
 		os.Exit(1)
 	}
 	switch os.Args[1] {
@@ -27,6 +27,20 @@ func main() {
 		handleField(os.Args[2:])
 	case "data":
 		handleData(os.Args[2:])
+	case "tx":
+		handleTx(os.Args[2:])
+	case "index":
+		handleIndex(os.Args[2:])
+	case "view":
+		handleView(os.Args[2:])
+	case "cache":
+		handleCache(os.Args[2:])
+	case "kv":
+		handleKV(os.Args[2:])
+	case "pubsub":
+		handlePubSub(os.Args[2:])
+	case "serve-redis":
+		handleServeRedis(os.Args[2:])
 	case "backup":
 		handleBackup(os.Args[2:])
 	case "restore":
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+func handlePubSub(args []string) {
+	if len(args) < 3 {
+		fmt.Println("Usage : pubsub <publish|subscribe|psubscribe> <database> <channel|pattern> [...]")
+		return
+	}
+
+	switch args[0] {
+	case "publish":
+		if len(args) != 4 {
+			fmt.Println("Usage : pubsub publish <database> <channel> <message>")
+			return
+		}
+		if _, err := database.Publish(args[1], args[2], args[3]); err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Message publié sur \"%s\".\n", args[2])
+	case "subscribe", "psubscribe":
+		sub, err := database.Subscribe(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		defer sub.Close()
+		if args[0] == "psubscribe" {
+			if _, err := sub.PSubscribe(args[2:]...); err != nil {
+				fmt.Println("Erreur :", err)
+				return
+			}
+		} else {
+			sub.Subscribe(args[2:]...)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		fmt.Println("En écoute (Ctrl+C pour arrêter)... Les modifications d'une table sont publiées sur changes:<table>.")
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-sub.C:
+				if !ok {
+					return
+				}
+				fmt.Printf("[%s] %s : %s\n", msg.Time.Format("15:04:05"), msg.Channel, msg.Payload)
+			}
+		}
+	default:
+		fmt.Printf("Commande inconnue : %s\n", args[0])
+	}
+}
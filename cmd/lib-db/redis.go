@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/database"
+	"github.com/fabian222222/lib-db/pkg/fs"
+	"github.com/fabian222222/lib-db/pkg/resp"
+)
+
+// redisServer expose le stockage clé-valeur avec le protocole Redis. Chaque
+// connexion s'authentifie avec AUTH puis choisit une base avec SELECT <nom>.
+type redisServer struct {
+	ctx      context.Context
+	nextID   atomic.Int64
+	mu       sync.Mutex
+	sweepers map[string]bool
+}
+
+// redisConn est une connexion cliente. mu protège w, utilisé aussi par la
+// goroutine qui remet les messages pub/sub.
+type redisConn struct {
+	server *redisServer
+	conn   net.Conn
+	r      *resp.Reader
+	mu     sync.Mutex
+	w      *resp.Writer
+	id     int64
+	user   string
+	db     string
+	name   string
+	sub    *database.Subscription
+}
+
+// multiReply regroupe plusieurs réponses à une même commande, comme les
+// confirmations de SUBSCRIBE pour chaque canal.
+type multiReply []any
+
+func handleServeRedis(args []string) {
+	host, port := "127.0.0.1", 6379
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--port" && i+1 < len(args):
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n <= 0 || n > 65535 {
+				fmt.Printf("Erreur : port invalide : \"%s\"\n", args[i])
+				return
+			}
+			port = n
+		case args[i] == "--host" && i+1 < len(args):
+			i++
+			host = args[i]
+		default:
+			fmt.Println("Usage : serve-redis [--port 6379] [--host 127.0.0.1]")
+			return
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		fmt.Println("Erreur :", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	fmt.Printf("Serveur Redis en écoute sur %s (Ctrl+C pour arrêter)\n", listener.Addr())
+
+	server := &redisServer{ctx: ctx, sweepers: map[string]bool{}}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				server.flushKV()
+				fmt.Println("Serveur arrêté.")
+				return
+			}
+			fmt.Println("Erreur :", err)
+			continue
+		}
+		c := &redisConn{
+			server: server,
+			conn:   conn,
+			r:      resp.NewReader(conn),
+			w:      resp.NewWriter(conn),
+			id:     server.nextID.Add(1),
+		}
+		go c.serve()
+	}
+}
+
+func (c *redisConn) serve() {
+	defer c.conn.Close()
+	defer func() {
+		if c.sub != nil {
+			c.sub.Close()
+		}
+	}()
+	stop := context.AfterFunc(c.server.ctx, func() { c.conn.Close() })
+	defer stop()
+	for {
+		args, err := c.r.ReadCommand()
+		if err != nil {
+			if errors.Is(err, resp.ErrProtocol) {
+				c.send(resp.Errorf("Protocol error: %v", err))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply, quit := c.exec(args)
+		if err := c.send(reply); err != nil || quit {
+			return
+		}
+	}
+}
+
+func (c *redisConn) send(reply any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replies, ok := reply.(multiReply)
+	if !ok {
+		replies = multiReply{reply}
+	}
+	for _, r := range replies {
+		if err := c.w.Write(r); err != nil {
+			return err
+		}
+	}
+	return c.w.Flush()
+}
+
+// exec traite les commandes de connexion et transmet les autres au
+// stockage clé-valeur de la base sélectionnée.
+func (c *redisConn) exec(args []string) (any, bool) {
+	name := strings.ToLower(args[0])
+	switch name {
+	case "quit":
+		return resp.SimpleString("OK"), true
+	case "hello":
+		return c.hello(args), false
+	case "auth":
+		return c.auth(args[1:]), false
+	}
+	if c.user == "" {
+		return resp.Error("NOAUTH Authentification requise."), false
+	}
+
+	if c.subscribed() && c.protocol() < 3 {
+		switch name {
+		case "subscribe", "psubscribe", "unsubscribe", "punsubscribe":
+		case "ping":
+			if len(args) > 1 {
+				return resp.Push{"pong", args[1]}, false
+			}
+			return resp.Push{"pong", ""}, false
+		default:
+			return resp.Errorf("impossible d'exécuter '%s' : seuls (P)SUBSCRIBE, (P)UNSUBSCRIBE, PING et QUIT sont autorisés pendant un abonnement", name), false
+		}
+	}
+
+	switch name {
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "publish":
+		return c.pubsub(name, args[1:]), false
+	case "ping":
+		if len(args) > 1 {
+			return args[1], false
+		}
+		return resp.SimpleString("PONG"), false
+	case "echo":
+		if len(args) != 2 {
+			return resp.Errorf("nombre d'arguments incorrect pour la commande 'echo'"), false
+		}
+		return args[1], false
+	case "select":
+		if len(args) != 2 {
+			return resp.Errorf("nombre d'arguments incorrect pour la commande 'select'"), false
+		}
+		if err := c.selectDB(args[1]); err != nil {
+			return err, false
+		}
+		return resp.SimpleString("OK"), false
+	case "client":
+		return c.client(args), false
+	case "command":
+		return []any{}, false
+	case "info":
+		return fmt.Sprintf("# Server\r\nredis_version:7.0.0\r\nlib_db_version:1.0\r\nredis_mode:standalone\r\n# Keyspace\r\nlib_db_database:%s\r\n", c.db), false
+	}
+
+	if !database.IsKVCommand(name) {
+		return resp.Errorf("commande inconnue '%s'", args[0]), false
+	}
+	if c.db == "" {
+		return resp.Errorf("aucune base sélectionnée (SELECT <base>)"), false
+	}
+	return database.ExecKVCommand(c.db, args), false
+}
+
+// hello négocie la version du protocole : HELLO [2|3 [AUTH user pass]
+// [SETNAME nom]].
+func (c *redisConn) hello(args []string) any {
+	protocol := c.protocol()
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return resp.Errorf("la version du protocole n'est pas un entier")
+		}
+		if n != 2 && n != 3 {
+			return resp.Error("NOPROTO version du protocole non prise en charge")
+		}
+		protocol = n
+	}
+	for i := 2; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(args[i], "auth") && i+2 < len(args):
+			if reply := c.auth(args[i+1 : i+3]); reply != resp.SimpleString("OK") {
+				return reply
+			}
+			i += 2
+		case strings.EqualFold(args[i], "setname") && i+1 < len(args):
+			c.name = args[i+1]
+			i++
+		default:
+			return resp.Errorf("erreur de syntaxe dans HELLO")
+		}
+	}
+	if c.user == "" {
+		return resp.Error("NOAUTH HELLO doit être appelé avec AUTH.")
+	}
+	c.mu.Lock()
+	c.w.Protocol = protocol
+	c.mu.Unlock()
+	return resp.Map{
+		"server", "lib-db",
+		"version", "7.0.0",
+		"proto", protocol,
+		"id", c.id,
+		"mode", "standalone",
+		"role", "master",
+		"modules", []any{},
+	}
+}
+
+// auth vérifie AUTH <utilisateur> <mot de passe> dans users.json puis
+// sélectionne la première base accessible à l'utilisateur.
+func (c *redisConn) auth(args []string) any {
+	if len(args) != 2 {
+		return resp.Errorf("utilisez AUTH <utilisateur> <mot de passe>")
+	}
+	ok, user, err := database.CheckCredentials(args[0], args[1])
+	if err != nil {
+		return resp.Errorf("%s", err.Error())
+	}
+	if !ok {
+		return resp.Error("WRONGPASS utilisateur ou mot de passe invalide.")
+	}
+	c.user, c.db = user.Username, ""
+	c.r.SetAuthenticated(true)
+	for _, db := range user.Databases {
+		if fs.DoesDirExist(db) {
+			c.selectDB(db)
+			break
+		}
+	}
+	return resp.SimpleString("OK")
+}
+
+func (c *redisConn) selectDB(db string) error {
+	if !fs.DoesDirExist(db) {
+		return resp.Errorf("la base de données \"%s\" n'existe pas", db)
+	}
+	if c.user != "admin" && !database.UserHasAccess(c.user, db) {
+		return resp.Error(fmt.Sprintf("NOPERM l'utilisateur \"%s\" n'a pas accès à la base \"%s\"", c.user, db))
+	}
+	c.db = db
+	c.server.startSweeper(db)
+	return nil
+}
+
+func (c *redisConn) client(args []string) any {
+	if len(args) < 2 {
+		return resp.Errorf("nombre d'arguments incorrect pour la commande 'client'")
+	}
+	switch strings.ToLower(args[1]) {
+	case "setname":
+		if len(args) != 3 {
+			return resp.Errorf("nombre d'arguments incorrect pour 'client setname'")
+		}
+		c.name = args[2]
+		return resp.SimpleString("OK")
+	case "getname":
+		if c.name == "" {
+			return nil
+		}
+		return c.name
+	case "id":
+		return c.id
+	case "setinfo":
+		return resp.SimpleString("OK")
+	}
+	return resp.Errorf("sous-commande inconnue '%s'", args[1])
+}
+
+// pubsub traite PUBLISH et les abonnements, sur la base sélectionnée. Les
+// messages sont remis par une goroutine créée au premier abonnement.
+func (c *redisConn) pubsub(name string, args []string) any {
+	if c.db == "" {
+		return resp.Errorf("aucune base sélectionnée (SELECT <base>)")
+	}
+	if name == "publish" {
+		if len(args) != 2 {
+			return resp.Errorf("nombre d'arguments incorrect pour la commande 'publish'")
+		}
+		n, err := database.Publish(c.db, args[0], args[1])
+		if err != nil {
+			return resp.Errorf("%s", err.Error())
+		}
+		return n
+	}
+	if (name == "subscribe" || name == "psubscribe") && len(args) == 0 {
+		return resp.Errorf("nombre d'arguments incorrect pour la commande '%s'", name)
+	}
+	if c.sub == nil {
+		sub, err := database.Subscribe(c.db)
+		if err != nil {
+			return resp.Errorf("%s", err.Error())
+		}
+		c.sub = sub
+		go c.deliver(sub)
+	}
+
+	replies := multiReply{}
+	switch name {
+	case "subscribe":
+		for _, channel := range args {
+			replies = append(replies, resp.Push{name, channel, c.sub.Subscribe(channel)})
+		}
+	case "psubscribe":
+		for _, pattern := range args {
+			count, err := c.sub.PSubscribe(pattern)
+			if err != nil {
+				return resp.Errorf("%s", err.Error())
+			}
+			replies = append(replies, resp.Push{name, pattern, count})
+		}
+	case "unsubscribe", "punsubscribe":
+		var removed []string
+		if name == "punsubscribe" {
+			removed = c.sub.PUnsubscribe(args...)
+		} else {
+			removed = c.sub.Unsubscribe(args...)
+		}
+		if len(removed) == 0 {
+			replies = append(replies, resp.Push{name, nil, c.sub.Count()})
+		}
+		for i, channel := range removed {
+			replies = append(replies, resp.Push{name, channel, c.sub.Count() + len(removed) - i - 1})
+		}
+	}
+	return replies
+}
+
+func (c *redisConn) deliver(sub *database.Subscription) {
+	for msg := range sub.C {
+		reply := resp.Push{"message", msg.Channel, msg.Payload}
+		if msg.Pattern != "" {
+			reply = resp.Push{"pmessage", msg.Pattern, msg.Channel, msg.Payload}
+		}
+		if err := c.send(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (c *redisConn) subscribed() bool {
+	return c.sub != nil && c.sub.Count() > 0
+}
+
+func (c *redisConn) protocol() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Protocol
+}
+
+// startSweeper lance l'expiration périodique des clés et des lignes d'une
+// base, et le nettoyage de ses anciennes versions, à sa première sélection.
+func (s *redisServer) startSweeper(db string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sweepers[db] {
+		return
+	}
+	s.sweepers[db] = true
+	database.StartKVExpiry(s.ctx, db, time.Second)
+	database.StartRowExpiry(s.ctx, db, time.Second)
+	database.StartVacuum(s.ctx, db, time.Minute)
+}
+
+// flushKV enregistre les modifications du stockage clé-valeur encore en
+// attente dans les bases utilisées.
+func (s *redisServer) flushKV() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for db := range s.sweepers {
+		if err := database.KVFlush(db); err != nil {
+			fmt.Println("Erreur :", err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 	"github.com/fabian222222/lib-db/pkg/database"
 )
@@ -125,9 +126,10 @@ func showDatabaseStats(dbName, username string) {
 	fmt.Println("═══════════════════════════════════════")
 	fmt.Printf("💾 Taille totale : %.2f KB\n", float64(dbStats.Size)/1024)
 	fmt.Printf("📋 Nombre de tables : %d\n", dbStats.TableCount)
+	fmt.Printf("🔎 Nombre d'index : %d\n", dbStats.IndexCount)
 	fmt.Printf("⏰ Dernière modification : %s\n", dbStats.LastModified.Format("02/01/2006 15:04:05"))
 
-	files := []string{"schema.txt", "cache.txt", "pending.txt"}
+	files := []string{"schema.txt", "pending.txt", "settings.json", "kv.json", "kv.aof"}
 	fmt.Println("\n📁 ANALYSE DES FICHIERS :")
 	fmt.Println("─────────────────────────")
 	
@@ -138,16 +140,48 @@ func showDatabaseStats(dbName, username string) {
 		}
 	}
 
-	dataPath := filepath.Join(dbPath, "data")
-	if info, err := os.Stat(dataPath); err == nil && info.IsDir() {
-		dataSize := int64(0)
-		filepath.Walk(dataPath, func(path string, info os.FileInfo, err error) error {
-			if err == nil && !info.IsDir() {
-				dataSize += info.Size()
-			}
-			return nil
-		})
-		fmt.Printf("• data/ : %.2f KB\n", float64(dataSize)/1024)
+	for _, dirName := range []string{"data", "indexes", "cache"} {
+		dirPath := filepath.Join(dbPath, dirName)
+		if info, err := os.Stat(dirPath); err == nil && info.IsDir() {
+			dirSize := int64(0)
+			filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					dirSize += info.Size()
+				}
+				return nil
+			})
+			fmt.Printf("• %s/ : %.2f KB\n", dirName, float64(dirSize)/1024)
+		}
+	}
+
+	if len(dbStats.KeyCounts) > 0 {
+		fmt.Println("\n🔑 CLÉS (KV) :")
+		fmt.Println("─────────────────────────")
+		types := make([]string, 0, len(dbStats.KeyCounts))
+		for kind := range dbStats.KeyCounts {
+			types = append(types, kind)
+		}
+		sort.Strings(types)
+		for _, kind := range types {
+			fmt.Printf("• %s : %d\n", kind, dbStats.KeyCounts[kind])
+		}
+	}
+
+	if cache := dbStats.Cache; cache != nil {
+		fmt.Println("\n⚡ CACHE DES SÉLECTIONS :")
+		fmt.Println("─────────────────────────")
+		fmt.Printf("• Entrées : %d (%.2f KB)\n", cache.Entries, float64(cache.Bytes)/1024)
+		fmt.Printf("• Succès : %d, échecs : %d (taux de succès %.1f%%)\n", cache.Hits, cache.Misses, cache.HitRate())
+		fmt.Printf("• Évictions : %d, invalidations : %d\n", cache.Evictions, cache.Invalidations)
+		tables := make([]string, 0, len(cache.Tables))
+		for table := range cache.Tables {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			c := cache.Tables[table]
+			fmt.Printf("  └─ %s : %d succès, %d échecs, %d évictions, %d invalidations\n", table, c.Hits, c.Misses, c.Evictions, c.Invalidations)
+		}
 	}
 }
 
@@ -7,7 +7,7 @@ import (
 
 func handleTable(args []string) {
 	if len(args) < 1 {
-		fmt.Println("Usage : table <add|delete|update|list>")
+		fmt.Println("Usage : table <add|delete|update|link|unlink|set>")
 		return
 	}
 
@@ -70,6 +70,17 @@ func handleTable(args []string) {
 			table2 = args[3]
 		}
 		database.UnlinkTables(dbName, table1, table2)
+	case "set":
+		if len(args) < 5 {
+			fmt.Println("Usage : table set <database> <table> <option> <value>")
+			fmt.Println("Options : history on|off, soft_delete on|off, retention <durée> (ex. 30d), ttl <durée>|off, expires_field <champ>|off")
+			return
+		}
+		if err := database.SetTableOption(args[1], args[2], args[3], args[4]); err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Option \"%s\" de la table \"%s\" mise à jour.\n", args[3], args[2])
 	default:
 		fmt.Printf("Commande inconnue : %s\n", args[0])
 	}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+// txSession exécute les instructions d'un script ou de la saisie
+// interactive. Une écriture hors BEGIN est validée immédiatement. En
+// script, failed marque une transaction en échec dont les instructions sont
+// ignorées jusqu'au ROLLBACK TO.
+type txSession struct {
+	db     string
+	tx     *database.Tx
+	failed bool
+}
+
+func handleTx(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage : tx <database> [script]        # Sans script : saisie interactive")
+		fmt.Println("        tx recover <database>         # Terminer les transactions interrompues")
+		return
+	}
+	if args[0] == "recover" {
+		if len(args) != 2 {
+			fmt.Println("Usage : tx recover <database>")
+			return
+		}
+		n, err := database.RecoverTransactions(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("%d transaction(s) reprise(s).\n", n)
+		return
+	}
+
+	input := io.Reader(os.Stdin)
+	interactive := false
+	if len(args) > 1 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		defer f.Close()
+		input = f
+	} else if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		interactive = true
+		fmt.Println("Instructions : BEGIN, INSERT <table> f=v..., UPDATE <table> <id> f=v..., DELETE <table> <id>, SELECT <table> [filtres], SAVEPOINT <nom>, ROLLBACK TO <nom>, RELEASE <nom>, COMMIT, ROLLBACK, EXIT")
+	}
+
+	session := &txSession{db: args[0]}
+	scanner := bufio.NewScanner(input)
+	line := 0
+	for {
+		if interactive {
+			if session.tx != nil {
+				fmt.Printf("%s*> ", session.db)
+			} else {
+				fmt.Printf("%s> ", session.db)
+			}
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line++
+		fields, err := splitStatement(scanner.Text())
+		if err != nil || len(fields) == 0 {
+			if err != nil {
+				fmt.Printf("Erreur ligne %d : %v\n", line, err)
+			}
+			continue
+		}
+		if strings.EqualFold(fields[0], "exit") || strings.EqualFold(fields[0], "quit") {
+			break
+		}
+		if session.failed {
+			switch strings.ToUpper(fields[0]) {
+			case "ROLLBACK":
+			case "COMMIT":
+				fmt.Printf("Erreur ligne %d : transaction en échec, COMMIT impossible\n", line)
+				session.abort()
+				return
+			default:
+				fmt.Printf("Ligne %d ignorée : transaction en échec jusqu'au ROLLBACK TO\n", line)
+				continue
+			}
+		}
+		if err := session.exec(fields); err != nil {
+			if interactive {
+				fmt.Println("Erreur :", err)
+				continue
+			}
+			fmt.Printf("Erreur ligne %d : %v\n", line, err)
+			// Avec un point de sauvegarde, le script peut se rattraper par
+			// un ROLLBACK TO.
+			if session.tx != nil && session.tx.HasSavepoint() && !session.failed {
+				session.failed = true
+				continue
+			}
+			session.abort()
+			return
+		}
+		session.failed = false
+	}
+	session.abort()
+}
+
+// abort annule la transaction restée ouverte.
+func (s *txSession) abort() {
+	if s.tx == nil {
+		return
+	}
+	s.tx.Rollback()
+	s.tx = nil
+	s.failed = false
+	fmt.Println("Transaction non validée : annulée.")
+}
+
+func (s *txSession) exec(fields []string) error {
+	keyword := strings.ToUpper(fields[0])
+	switch keyword {
+	case "BEGIN":
+		if s.tx != nil {
+			return fmt.Errorf("une transaction est déjà ouverte")
+		}
+		tx, err := database.Begin(s.db)
+		if err != nil {
+			return err
+		}
+		s.tx = tx
+		fmt.Println("BEGIN")
+		return nil
+	case "SAVEPOINT", "RELEASE":
+		name, err := savepointName(fields)
+		if err != nil {
+			return err
+		}
+		if s.tx == nil {
+			return fmt.Errorf("aucune transaction ouverte")
+		}
+		if keyword == "RELEASE" {
+			err = s.tx.Release(name)
+		} else {
+			err = s.tx.Savepoint(name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(keyword, name)
+		return nil
+	case "COMMIT", "ROLLBACK":
+		if keyword == "ROLLBACK" && len(fields) > 1 {
+			if !strings.EqualFold(fields[1], "to") {
+				return fmt.Errorf("usage : ROLLBACK TO [SAVEPOINT] <nom>")
+			}
+			name, err := savepointName(fields[1:])
+			if err != nil {
+				return err
+			}
+			if s.tx == nil {
+				return fmt.Errorf("aucune transaction ouverte")
+			}
+			if err := s.tx.RollbackTo(name); err != nil {
+				return err
+			}
+			fmt.Println("ROLLBACK TO", name)
+			return nil
+		}
+		if s.tx == nil {
+			return fmt.Errorf("aucune transaction ouverte")
+		}
+		tx := s.tx
+		s.tx = nil
+		if keyword == "ROLLBACK" {
+			fmt.Printf("ROLLBACK (%d ligne(s) abandonnée(s))\n", tx.Pending())
+			return tx.Rollback()
+		}
+		pending := tx.Pending()
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		fmt.Printf("COMMIT (%d ligne(s))\n", pending)
+		return nil
+	case "INSERT", "UPDATE", "DELETE", "SELECT":
+	default:
+		return fmt.Errorf("instruction inconnue : %s", fields[0])
+	}
+
+	tx := s.tx
+	if tx == nil {
+		var err error
+		if tx, err = database.Begin(s.db); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+	}
+	if err := runTxStatement(tx, keyword, fields[1:]); err != nil {
+		return err
+	}
+	if s.tx == nil && keyword != "SELECT" {
+		return tx.Commit()
+	}
+	return nil
+}
+
+func runTxStatement(tx *database.Tx, keyword string, args []string) error {
+	switch keyword {
+	case "INSERT":
+		if len(args) < 1 {
+			return fmt.Errorf("usage : INSERT <table> field=value ...")
+		}
+		values, err := parseAssignments(args[1:])
+		if err != nil {
+			return err
+		}
+		id, err := tx.Insert(args[0], values)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("INSERT %s\n", id)
+	case "UPDATE":
+		if len(args) < 3 {
+			return fmt.Errorf("usage : UPDATE <table> <id> field=value ...")
+		}
+		values := map[string]string{}
+		for _, arg := range args[2:] {
+			field, expr, ok := database.ParseAssignment(arg)
+			if !ok {
+				return fmt.Errorf("affectation invalide : \"%s\" (format attendu : champ=valeur)", arg)
+			}
+			values[field] = expr
+		}
+		if err := tx.Update(args[0], args[1], values); err != nil {
+			return err
+		}
+		fmt.Printf("UPDATE %s\n", args[1])
+	case "DELETE":
+		if len(args) != 2 {
+			return fmt.Errorf("usage : DELETE <table> <id>")
+		}
+		if err := tx.Delete(args[0], args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("DELETE %s\n", args[1])
+	case "SELECT":
+		if len(args) < 1 {
+			return fmt.Errorf("usage : SELECT <table> [field=value field>value ...]")
+		}
+		query := database.Query{Table: args[0]}
+		for _, arg := range args[1:] {
+			cond, err := database.ParseCondition(arg)
+			if err != nil {
+				return err
+			}
+			query.Conditions = append(query.Conditions, cond)
+		}
+		rows, err := tx.Select(query)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			fmt.Println(row)
+		}
+		fmt.Printf("(%d ligne(s))\n", len(rows))
+	}
+	return nil
+}
+
+// savepointName lit le nom dans "SAVEPOINT nom", "RELEASE [SAVEPOINT] nom"
+// ou "TO [SAVEPOINT] nom".
+func savepointName(fields []string) (string, error) {
+	args := fields[1:]
+	if len(args) == 2 && strings.EqualFold(args[0], "savepoint") {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage : %s [SAVEPOINT] <nom>", strings.ToUpper(fields[0]))
+	}
+	return args[0], nil
+}
+
+func parseAssignments(args []string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("affectation invalide : \"%s\" (format attendu : champ=valeur)", arg)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// splitStatement découpe une instruction en mots. Les guillemets simples ou
+// doubles regroupent des espaces ; un point-virgule final et les
+// commentaires (-- ou #) sont ignorés.
+func splitStatement(line string) ([]string, error) {
+	fields := []string{}
+	var current strings.Builder
+	inField := false
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, current.String())
+				current.Reset()
+				inField = false
+			}
+		case r == '#' && !inField, r == '-' && !inField && strings.HasPrefix(line[i:], "--"):
+			return trimSemicolon(fields), nil
+		default:
+			current.WriteRune(r)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("guillemet non fermé")
+	}
+	if inField {
+		fields = append(fields, current.String())
+	}
+	return trimSemicolon(fields), nil
+}
+
+func trimSemicolon(fields []string) []string {
+	if len(fields) == 0 {
+		return fields
+	}
+	last := strings.TrimSuffix(fields[len(fields)-1], ";")
+	if last == "" {
+		return fields[:len(fields)-1]
+	}
+	fields[len(fields)-1] = last
+	return fields
+}
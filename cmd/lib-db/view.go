@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/database"
+)
+
+func handleView(args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage : view <create|drop|list|refresh>")
+		return
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 4 {
+			fmt.Println("Usage : view create <database> <name> <table> [field=value field>value ...] [--materialized] [--auto-refresh]")
+			return
+		}
+		query := database.Query{Table: args[3]}
+		materialized, autoRefresh := false, false
+		for _, arg := range args[4:] {
+			switch arg {
+			case "--materialized":
+				materialized = true
+			case "--auto-refresh":
+				materialized, autoRefresh = true, true
+			default:
+				cond, err := database.ParseCondition(arg)
+				if err != nil {
+					fmt.Println("Erreur :", err)
+					return
+				}
+				query.Conditions = append(query.Conditions, cond)
+			}
+		}
+		err := database.CreateView(args[1], args[2], query, materialized, autoRefresh)
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Vue \"%s\" créée.\n", args[2])
+	case "drop":
+		if len(args) < 3 {
+			fmt.Println("Usage : view drop <database> <name>")
+			return
+		}
+		err := database.DropView(args[1], args[2])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Vue \"%s\" supprimée.\n", args[2])
+	case "list":
+		if len(args) < 2 {
+			fmt.Println("Usage : view list <database>")
+			return
+		}
+		views, err := database.ListViews(args[1])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		if len(views) == 0 {
+			fmt.Println("Aucune vue.")
+			return
+		}
+		for _, view := range views {
+			conditions := []string{}
+			for _, cond := range view.Conditions {
+				conditions = append(conditions, cond.String())
+			}
+			fmt.Printf("• %s : %s", view.Name, view.Table)
+			if len(conditions) > 0 {
+				fmt.Printf(" WHERE %s", strings.Join(conditions, " AND "))
+			}
+			if view.Materialized {
+				fmt.Printf(" (matérialisée, rafraîchie le %s", view.RefreshedAt.Format("02/01/2006 15:04:05"))
+				if view.AutoRefresh {
+					fmt.Print(", automatique")
+				}
+				fmt.Print(")")
+			}
+			fmt.Println()
+		}
+	case "refresh":
+		if len(args) < 3 {
+			fmt.Println("Usage : view refresh <database> <name>")
+			return
+		}
+		err := database.RefreshView(args[1], args[2])
+		if err != nil {
+			fmt.Println("Erreur :", err)
+			return
+		}
+		fmt.Printf("Vue \"%s\" rafraîchie.\n", args[2])
+	default:
+		fmt.Printf("Commande inconnue : %s\n", args[0])
+	}
+}
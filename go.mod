@@ -3,6 +3,7 @@ module github.com/fabian222222/lib-db
 go 1.24.1
 
 require (
-	github.com/lucsky/cuid v1.2.1 // indirect
-	golang.org/x/crypto v0.39.0 // indirect
+	github.com/lucsky/cuid v1.2.1
+	golang.org/x/crypto v0.39.0
+	golang.org/x/text v0.26.0
 )
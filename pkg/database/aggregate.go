@@ -0,0 +1,316 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var allowedAggregates = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+}
+
+type Aggregate struct {
+	Func     string `json:"func"`
+	Field    string `json:"field"`
+	Distinct bool   `json:"distinct"`
+}
+
+type HavingClause struct {
+	Aggregate Aggregate `json:"aggregate"`
+	Op        string    `json:"op"`
+	Value     float64   `json:"value"`
+}
+
+type AggregateQuery struct {
+	DBName     string            `json:"dbName"`
+	Table      string            `json:"table"`
+	Where      map[string]string `json:"where"`
+	GroupBy    []string          `json:"groupBy"`
+	Aggregates []Aggregate       `json:"aggregates"`
+	Having     []HavingClause    `json:"having"`
+}
+
+// Name retourne le nom de colonne du résultat, ex: "sum(price)" ou "count(distinct name)".
+func (a Aggregate) Name() string {
+	if a.Distinct {
+		return fmt.Sprintf("%s(distinct %s)", a.Func, a.Field)
+	}
+	return fmt.Sprintf("%s(%s)", a.Func, a.Field)
+}
+
+func ParseAggregate(expr string) (Aggregate, error) {
+	expr = strings.TrimSpace(expr)
+	open := strings.Index(expr, "(")
+	if open <= 0 || !strings.HasSuffix(expr, ")") {
+		return Aggregate{}, fmt.Errorf("agrégat invalide : '%s' (format attendu: fonction(champ))", expr)
+	}
+
+	agg := Aggregate{
+		Func:  strings.ToLower(strings.TrimSpace(expr[:open])),
+		Field: strings.TrimSpace(expr[open+1 : len(expr)-1]),
+	}
+	if lower := strings.ToLower(agg.Field); strings.HasPrefix(lower, "distinct ") {
+		agg.Distinct = true
+		agg.Field = strings.TrimSpace(agg.Field[len("distinct "):])
+	}
+
+	if !allowedAggregates[agg.Func] {
+		return Aggregate{}, fmt.Errorf("fonction d'agrégat non autorisée : '%s'", agg.Func)
+	}
+	if agg.Field == "" {
+		return Aggregate{}, fmt.Errorf("champ manquant dans l'agrégat '%s'", expr)
+	}
+	if agg.Field == "*" && (agg.Func != "count" || agg.Distinct) {
+		return Aggregate{}, fmt.Errorf("'*' n'est autorisé qu'avec count")
+	}
+	return agg, nil
+}
+
+func ParseHaving(expr string) (HavingClause, error) {
+	for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+		idx := strings.Index(expr, op)
+		if idx <= 0 {
+			continue
+		}
+		agg, err := ParseAggregate(expr[:idx])
+		if err != nil {
+			return HavingClause{}, err
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(expr[idx+len(op):]), 64)
+		if err != nil {
+			return HavingClause{}, fmt.Errorf("valeur numérique attendue dans HAVING : '%s'", expr)
+		}
+		return HavingClause{Aggregate: agg, Op: op, Value: value}, nil
+	}
+	return HavingClause{}, fmt.Errorf("clause HAVING invalide : '%s'", expr)
+}
+
+// AggregateData regroupe les lignes retournées par SelectData selon GroupBy
+// et calcule les agrégats demandés pour chaque groupe. Sans agrégat, le
+// résultat correspond à un SELECT DISTINCT sur les champs de GroupBy.
+func AggregateData(query AggregateQuery) ([]map[string]string, error) {
+	schema, err := loadSchema(query.DBName)
+	if err != nil {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", query.DBName)
+	}
+	fields, ok := schema[query.Table]
+	if !ok {
+		return nil, fmt.Errorf("la table \"%s\" n'existe pas", query.Table)
+	}
+	types := fieldTypes(fields)
+
+	for _, field := range query.GroupBy {
+		if _, ok := types[field]; !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", field, query.Table)
+		}
+	}
+	aggregates := append([]Aggregate{}, query.Aggregates...)
+	for _, having := range query.Having {
+		aggregates = append(aggregates, having.Aggregate)
+	}
+	for _, agg := range aggregates {
+		if agg.Field == "*" {
+			continue
+		}
+		fieldType, ok := types[agg.Field]
+		if !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", agg.Field, query.Table)
+		}
+		if (agg.Func == "sum" || agg.Func == "avg") && fieldType != "int" && fieldType != "float" {
+			return nil, fmt.Errorf("%s impossible sur le champ \"%s\" de type %s", agg.Func, agg.Field, fieldType)
+		}
+	}
+
+	rows, err := SelectData(query.DBName, query.Table, query.Where)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]map[string]string)
+	for _, row := range rows {
+		key := groupKey(row, query.GroupBy)
+		groups[key] = append(groups[key], row)
+	}
+	if len(groups) == 0 && len(query.GroupBy) == 0 {
+		groups[""] = []map[string]string{}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	results := []map[string]string{}
+	for _, key := range keys {
+		groupRows := groups[key]
+		result := map[string]string{}
+		for _, field := range query.GroupBy {
+			if len(groupRows) > 0 {
+				result[field] = groupRows[0][field]
+			}
+		}
+
+		keep := true
+		for _, having := range query.Having {
+			value, err := computeAggregate(having.Aggregate, groupRows, types[having.Aggregate.Field])
+			if err != nil {
+				return nil, err
+			}
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil || !compareFloat(number, having.Op, having.Value) {
+				keep = false
+				break
+			}
+		}
+		if !keep {
+			continue
+		}
+
+		for _, agg := range query.Aggregates {
+			value, err := computeAggregate(agg, groupRows, types[agg.Field])
+			if err != nil {
+				return nil, err
+			}
+			result[agg.Name()] = value
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+func groupKey(row map[string]string, groupBy []string) string {
+	parts := make([]string, len(groupBy))
+	for i, field := range groupBy {
+		parts[i] = strconv.Quote(row[field])
+	}
+	return strings.Join(parts, ",")
+}
+
+func computeAggregate(agg Aggregate, rows []map[string]string, fieldType string) (string, error) {
+	if agg.Field == "*" {
+		return strconv.Itoa(len(rows)), nil
+	}
+
+	values := []string{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		val, ok := row[agg.Field]
+		if !ok || val == "" {
+			continue
+		}
+		if agg.Distinct {
+			if seen[val] {
+				continue
+			}
+			seen[val] = true
+		}
+		values = append(values, val)
+	}
+
+	switch agg.Func {
+	case "count":
+		return strconv.Itoa(len(values)), nil
+	case "sum", "avg":
+		if agg.Func == "sum" && fieldType == "int" {
+			return sumInts(values, agg.Field)
+		}
+		total := 0.0
+		for _, val := range values {
+			number, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return "", fmt.Errorf("valeur non numérique \"%s\" pour le champ \"%s\"", val, agg.Field)
+			}
+			total += number
+		}
+		if agg.Func == "avg" {
+			if len(values) == 0 {
+				return "", nil
+			}
+			return strconv.FormatFloat(total/float64(len(values)), 'f', -1, 64), nil
+		}
+		return strconv.FormatFloat(total, 'f', -1, 64), nil
+	case "min", "max":
+		best := ""
+		for i, val := range values {
+			cmp, err := compareTyped(val, best, fieldType)
+			if err != nil {
+				return "", err
+			}
+			if i == 0 || (agg.Func == "min" && cmp < 0) || (agg.Func == "max" && cmp > 0) {
+				best = val
+			}
+		}
+		return best, nil
+	}
+	return "", fmt.Errorf("fonction d'agrégat non autorisée : '%s'", agg.Func)
+}
+
+// sumInts additionne les valeurs d'un champ int sans passer par float64,
+// exact jusqu'aux limites d'int64 ; un dépassement est une erreur.
+func sumInts(values []string, field string) (string, error) {
+	var total int64
+	for _, val := range values {
+		number, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("valeur entière invalide \"%s\" pour le champ \"%s\"", val, field)
+		}
+		if (number > 0 && total > math.MaxInt64-number) || (number < 0 && total < math.MinInt64-number) {
+			return "", fmt.Errorf("dépassement de capacité pour sum(%s)", field)
+		}
+		total += number
+	}
+	return strconv.FormatInt(total, 10), nil
+}
+
+// compareTyped compare deux valeurs selon le type du champ : numérique pour
+// int et float, lexicographique sinon (les datetime sont au format ISO).
+func compareTyped(a, b, fieldType string) (int, error) {
+	if fieldType == "int" || fieldType == "float" {
+		if b == "" {
+			return 1, nil
+		}
+		x, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			return 0, fmt.Errorf("valeur non numérique \"%s\"", a)
+		}
+		y, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return 0, fmt.Errorf("valeur non numérique \"%s\"", b)
+		}
+		switch {
+		case x < y:
+			return -1, nil
+		case x > y:
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return strings.Compare(a, b), nil
+}
+
+func compareFloat(a float64, op string, b float64) bool {
+	switch op {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
@@ -169,7 +169,9 @@ func RestoreBackup(backupFile, newDbName string) error {
 		}
 	}
 
-	return nil
+	// Le cache de la sauvegarde peut ne plus correspondre aux données
+	// restaurées (sauvegarde prise pendant une écriture) : on repart à vide.
+	return clearSelectCache(newDbName)
 }
 
 func GetBackupInfo(backupFile string) (*BackupMetadata, error) {
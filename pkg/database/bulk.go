@@ -0,0 +1,174 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// UpdateWhere applique updates à toutes les lignes qui vérifient les
+// conditions et retourne leurs ids. Les valeurs marquées par Expr sont
+// évaluées sur chaque ligne. Les nouvelles lignes sont écrites dans
+// pending.txt avant d'être appliquées, pour pouvoir rejouer l'opération avec
+// `data cache` en cas d'interruption. Avec dryRun, rien n'est modifié.
+func UpdateWhere(databaseName, tableName string, conditions []Condition, updates map[string]string, dryRun bool) ([]string, error) {
+	if len(updates) == 0 {
+		return nil, fmt.Errorf("aucun champ à mettre à jour")
+	}
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	types := fieldTypes(schema[tableName])
+	for field := range updates {
+		if field == "id" {
+			return nil, fmt.Errorf("le champ \"id\" ne peut pas être modifié")
+		}
+		if _, ok := types[field]; !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", field, tableName)
+		}
+	}
+
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rows, err := selectLatest(Query{DBName: databaseName, Table: tableName, Conditions: conditions})
+	if err != nil {
+		return nil, err
+	}
+	ids := rowIDs(rows)
+	if dryRun || len(rows) == 0 {
+		return ids, nil
+	}
+
+	updated := make([]map[string]string, len(rows))
+	for i, row := range rows {
+		updated[i] = copyRow(row)
+		for field, expr := range updates {
+			val, err := evalUpdateExpr(field, expr, row, types)
+			if err != nil {
+				return nil, fmt.Errorf("expression invalide pour \"%s\" sur \"%s\" : %v", field, row["id"], err)
+			}
+			if err := checkForeignKey(databaseName, field, val); err != nil {
+				return nil, err
+			}
+			updated[i][field] = val
+		}
+	}
+
+	if err := SaveQueryToCache(CachedQuery{
+		Action: "update_many",
+		DBName: databaseName,
+		Table:  tableName,
+		Rows:   updated,
+	}); err != nil {
+		return nil, err
+	}
+
+	// Une seule validation : un lecteur voit toutes les lignes modifiées ou
+	// aucune.
+	seq, end, err := beginCommit(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	for i := range rows {
+		if err := writeRowAt(databaseName, tableName, rows[i], updated[i], seq); err != nil {
+			undoBulk(databaseName, tableName, rows[:i], updated[:i], seq)
+			ClearCacheFile(databaseName)
+			return nil, fmt.Errorf("échec de la mise à jour de \"%s\", opération annulée : %v", rows[i]["id"], err)
+		}
+	}
+
+	return ids, ClearCacheFile(databaseName)
+}
+
+// DeleteWhere supprime toutes les lignes qui vérifient les conditions et
+// retourne leurs ids. Avec dryRun, rien n'est supprimé.
+func DeleteWhere(databaseName, tableName string, conditions []Condition, dryRun bool) ([]string, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rows, err := selectLatest(Query{DBName: databaseName, Table: tableName, Conditions: conditions})
+	if err != nil {
+		return nil, err
+	}
+	ids := rowIDs(rows)
+	if dryRun || len(rows) == 0 {
+		return ids, nil
+	}
+
+	deleted := make([]map[string]string, len(ids))
+	for i, id := range ids {
+		deleted[i] = map[string]string{"id": id}
+	}
+	if err := SaveQueryToCache(CachedQuery{
+		Action: "delete_many",
+		DBName: databaseName,
+		Table:  tableName,
+		Rows:   deleted,
+	}); err != nil {
+		return nil, err
+	}
+
+	seq, end, err := beginCommit(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	for i, row := range rows {
+		if err := deleteRowAt(databaseName, tableName, row, seq); err != nil {
+			undoBulk(databaseName, tableName, rows[:i], nil, seq)
+			ClearCacheFile(databaseName)
+			return nil, fmt.Errorf("échec de la suppression de \"%s\", opération annulée : %v", row["id"], err)
+		}
+	}
+
+	return ids, ClearCacheFile(databaseName)
+}
+
+// undoBulk réécrit les lignes d'origine déjà modifiées (current) ou supprimées
+// (current nil) lors d'une opération groupée interrompue par une erreur.
+func undoBulk(databaseName, tableName string, originals, current []map[string]string, seq int64) {
+	for i, original := range originals {
+		var now map[string]string
+		if current != nil {
+			now = current[i]
+		} else if entry, err := readRow(databaseName, tableName, original["id"]); err == nil {
+			now = entry
+		}
+		writeImageAt(databaseName, tableName, now, copyRow(original), seq)
+	}
+}
+
+func checkForeignKey(databaseName, field, val string) error {
+	if !strings.HasSuffix(field, "_id") || val == "" {
+		return nil
+	}
+	relatedTable := strings.TrimSuffix(field, "_id")
+	if !fs.DoesDirExist(filepath.Join(databaseName, "data", relatedTable)) {
+		return fmt.Errorf("la table liée \"%s\" n'existe pas pour la clé étrangère \"%s\"", relatedTable, field)
+	}
+	if !fs.DoesDataFileExist(databaseName, relatedTable, val) {
+		return fmt.Errorf("la valeur \"%s\" pour \"%s\" n'existe pas dans la table \"%s\"", val, field, relatedTable)
+	}
+	return nil
+}
+
+func rowIDs(rows []map[string]string) []string {
+	ids := make([]string, len(rows))
+	for i, row := range rows {
+		ids[i] = row["id"]
+	}
+	return ids
+}
@@ -1,10 +1,17 @@
 package database
 
 import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"os"
-	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
 )
 
 type SelectQuery struct {
@@ -13,57 +20,395 @@ type SelectQuery struct {
 	Where  map[string]string `json:"where"`
 }
 
+// CachedSelect associe un résultat aux tables lues et à leur génération au
+// moment de la lecture. Toute écriture dans une de ces tables incrémente sa
+// génération (voir invalidateTables) et rend l'entrée obsolète.
 type CachedSelect struct {
-	Query  SelectQuery        `json:"query"`
-	Result []map[string]string   `json:"result"` 
+	Query       SelectQuery         `json:"query"`
+	Result      []map[string]string `json:"result"`
+	Generations map[string]int64    `json:"generations,omitempty"`
+	CreatedAt   time.Time           `json:"created_at"`
+	ExpiresAt   time.Time           `json:"expires_at,omitempty"`
 }
 
+// generationsEpochKey est la clé de generations.json qui donne la génération
+// des tables absentes du fichier (aucun nom de table n'est vide).
+const generationsEpochKey = ""
+
+// Le cache des sélections a deux niveaux : une LRU en mémoire par base,
+// propre au processus, et un niveau disque partagé (un fichier par entrée
+// dans cache/, la date de modification servant d'ordre LRU). Les deux sont
+// bornés par les limites de CacheConfig.
+type memoryEntry struct {
+	key   string
+	entry *CachedSelect
+	size  int64
+}
+
+type lruCache struct {
+	items map[string]*list.Element
+	order *list.List
+	bytes int64
+}
+
+var memoryCache = struct {
+	sync.Mutex
+	dbs map[string]*lruCache
+}{dbs: map[string]*lruCache{}}
+
 func SaveSelectCache(query SelectQuery, result []map[string]string) error {
-	cachePath := filepath.Join("./../../databases", query.DBName, "cache.txt")
+	generations, err := tableGenerations(query.DBName, cacheTables(query.DBName, query.Table))
+	if err != nil {
+		return err
+	}
+	return saveSelectCache(query, result, generations)
+}
 
-	var cache []CachedSelect
+// saveSelectCache enregistre le résultat avec les générations relevées
+// avant la lecture : si une table a été modifiée entre-temps, le résultat
+// n'est pas mis en cache.
+func saveSelectCache(query SelectQuery, result []map[string]string, generations map[string]int64) error {
+	config, err := GetCacheConfig(query.DBName)
+	if err != nil || !config.Enabled {
+		return err
+	}
+	current, err := tableGenerations(query.DBName, mapKeys(generations))
+	if err != nil || !reflect.DeepEqual(current, generations) {
+		return err
+	}
 
-	if content, err := os.ReadFile(cachePath); err == nil && len(content) > 0 {
-		json.Unmarshal(content, &cache)
+	entry := &CachedSelect{
+		Query:       query,
+		Result:      result,
+		Generations: generations,
+		CreatedAt:   time.Now(),
+	}
+	if config.TTL > 0 {
+		entry.ExpiresAt = entry.CreatedAt.Add(config.TTL)
 	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(content))
+	if size > config.MaxBytes {
+		return nil
+	}
+
+	key := cacheKey(query)
+	if err := os.MkdirAll(fs.GetCacheDirPath(query.DBName), 0755); err != nil {
+		return err
+	}
+	path := fs.GetCacheEntryFile(query.DBName, key)
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	memoryPut(query.DBName, key, entry, size, config)
+	_, err = evictDisk(query.DBName, config)
+	return err
+}
 
-	for _, entry := range cache {
-		if reflect.DeepEqual(entry.Query, query) {
-			return nil
+func GetCachedSelectResult(query SelectQuery) ([]map[string]string, bool, error) {
+	config, err := GetCacheConfig(query.DBName)
+	if err != nil || !config.Enabled {
+		return nil, false, err
+	}
+	key := cacheKey(query)
+
+	entry := memoryGet(query.DBName, key)
+	if entry == nil {
+		entry = diskGet(query.DBName, key)
+		if entry == nil {
+			recordCacheEvent(query.DBName, query.Table, "miss", 1)
+			return nil, false, nil
 		}
+		content, _ := json.Marshal(entry)
+		memoryPut(query.DBName, key, entry, int64(len(content)), config)
 	}
 
-	cache = append(cache, CachedSelect{
-		Query:  query,
-		Result: result,
-	})
+	if !reflect.DeepEqual(entry.Query, query) {
+		recordCacheEvent(query.DBName, query.Table, "miss", 1)
+		return nil, false, nil
+	}
+	if !entry.ExpiresAt.IsZero() && time.Now().After(entry.ExpiresAt) {
+		removeCacheEntry(query.DBName, key)
+		recordCacheEvent(query.DBName, query.Table, "eviction", 1)
+		recordCacheEvent(query.DBName, query.Table, "miss", 1)
+		return nil, false, nil
+	}
+	current, err := tableGenerations(query.DBName, mapKeys(entry.Generations))
+	if err != nil {
+		return nil, false, err
+	}
+	if entry.Generations == nil || !reflect.DeepEqual(current, entry.Generations) {
+		removeCacheEntry(query.DBName, key)
+		recordCacheEvent(query.DBName, query.Table, "invalidation", 1)
+		recordCacheEvent(query.DBName, query.Table, "miss", 1)
+		return nil, false, nil
+	}
+
+	now := time.Now()
+	os.Chtimes(fs.GetCacheEntryFile(query.DBName, key), now, now)
+	recordCacheEvent(query.DBName, query.Table, "hit", 1)
+	return entry.Result, true, nil
+}
 
-	content, err := json.MarshalIndent(cache, "", "  ")
+// invalidateTables incrémente la génération des tables modifiées et retire
+// du cache les résultats en mémoire qui les lisent. Les autres entrées du
+// cache disque sont écartées (et comptées) à leur prochaine lecture.
+func invalidateTables(databaseName string, tables ...string) error {
+	path := fs.GetGenerationsFilePath(databaseName)
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return err
+	}
+	generations, err := loadGenerations(databaseName)
+	if err != nil {
+		unlock()
+		return err
+	}
+	for _, table := range tables {
+		generations[table] = generationOf(generations, table) + 1
+	}
+	content, err := json.MarshalIndent(generations, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, content)
+	}
+	unlock()
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(cachePath, content, 0644)
+	invalidated := map[string]int64{}
+	memoryCache.Lock()
+	if lru := memoryCache.dbs[databaseName]; lru != nil {
+		for key, elem := range lru.items {
+			entry := elem.Value.(*memoryEntry).entry
+			for _, table := range tables {
+				if _, ok := entry.Generations[table]; ok {
+					lru.remove(key)
+					// Le fichier est retiré aussi : l'invalidation n'est
+					// comptée qu'une fois, ici plutôt qu'à la lecture.
+					os.Remove(fs.GetCacheEntryFile(databaseName, key))
+					invalidated[entry.Query.Table]++
+					break
+				}
+			}
+		}
+	}
+	memoryCache.Unlock()
+	for table, n := range invalidated {
+		recordCacheEvent(databaseName, table, "invalidation", n)
+	}
+	return nil
 }
 
-func GetCachedSelectResult(query SelectQuery) ([]map[string]string, bool, error) {
-	cachePath := filepath.Join("./../../databases", query.DBName, "cache.txt")
+// clearSelectCache vide le cache des sélections de la base.
+func clearSelectCache(databaseName string) error {
+	memoryCache.Lock()
+	delete(memoryCache.dbs, databaseName)
+	memoryCache.Unlock()
 
-	content, err := os.ReadFile(cachePath)
-	if err != nil || len(content) == 0 {
-		return nil, false, nil
+	os.Remove(fs.GetCacheFilePath(databaseName))
+	if err := os.RemoveAll(fs.GetCacheDirPath(databaseName)); err != nil {
+		return err
 	}
+	return nil
+}
 
-	var cache []CachedSelect
-	if err := json.Unmarshal(content, &cache); err != nil {
-		return nil, false, err
+func diskGet(databaseName, key string) *CachedSelect {
+	content, err := os.ReadFile(fs.GetCacheEntryFile(databaseName, key))
+	if err != nil {
+		return nil
+	}
+	var entry CachedSelect
+	if err := json.Unmarshal(content, &entry); err != nil {
+		os.Remove(fs.GetCacheEntryFile(databaseName, key))
+		return nil
 	}
+	return &entry
+}
 
-	for _, entry := range cache {
-		if reflect.DeepEqual(entry.Query, query) {
-			return entry.Result, true, nil
+// evictDisk supprime les entrées les moins récemment utilisées du cache
+// disque jusqu'à respecter les limites, et retourne leur nombre.
+func evictDisk(databaseName string, config CacheConfig) (int, error) {
+	files, err := os.ReadDir(fs.GetCacheDirPath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
 		}
+		return 0, err
 	}
+	type diskEntry struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	entries := []diskEntry{}
+	total := int64(0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, diskEntry{strings.TrimSuffix(file.Name(), ".json"), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.Before(entries[j].modTime)
+	})
 
-	return nil, false, nil
+	evicted := 0
+	for len(entries)-evicted > config.MaxEntries || total > config.MaxBytes {
+		oldest := entries[evicted]
+		removeCacheEntry(databaseName, oldest.key)
+		recordCacheEvent(databaseName, cacheKeyTable(oldest.key), "eviction", 1)
+		total -= oldest.size
+		evicted++
+	}
+	return evicted, nil
+}
+
+func removeCacheEntry(databaseName, key string) {
+	os.Remove(fs.GetCacheEntryFile(databaseName, key))
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	if lru := memoryCache.dbs[databaseName]; lru != nil {
+		lru.remove(key)
+	}
+}
+
+func memoryGet(databaseName, key string) *CachedSelect {
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	lru := memoryCache.dbs[databaseName]
+	if lru == nil {
+		return nil
+	}
+	elem, ok := lru.items[key]
+	if !ok {
+		return nil
+	}
+	lru.order.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).entry
+}
+
+func memoryPut(databaseName, key string, entry *CachedSelect, size int64, config CacheConfig) {
+	memoryCache.Lock()
+	defer memoryCache.Unlock()
+	lru := memoryCache.dbs[databaseName]
+	if lru == nil {
+		lru = &lruCache{items: map[string]*list.Element{}, order: list.New()}
+		memoryCache.dbs[databaseName] = lru
+	}
+	lru.remove(key)
+	lru.items[key] = lru.order.PushFront(&memoryEntry{key: key, entry: entry, size: size})
+	lru.bytes += size
+	for lru.order.Len() > config.MaxEntries || lru.bytes > config.MaxBytes {
+		lru.remove(lru.order.Back().Value.(*memoryEntry).key)
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.bytes -= elem.Value.(*memoryEntry).size
+	c.order.Remove(elem)
+	delete(c.items, key)
+}
+
+// cacheKey nomme l'entrée <table>_<sha1 de la requête>, pour retrouver la
+// table d'une entrée sans la lire.
+func cacheKey(query SelectQuery) string {
+	content, _ := json.Marshal(query)
+	sum := sha1.Sum(content)
+	return query.Table + "_" + hex.EncodeToString(sum[:])
+}
+
+func cacheKeyTable(key string) string {
+	if idx := strings.LastIndex(key, "_"); idx > 0 {
+		return key[:idx]
+	}
+	return ""
+}
+
+// cacheTables retourne les tables lues par une sélection : la table
+// elle-même, ou la vue et sa table de base.
+func cacheTables(databaseName, tableName string) []string {
+	tables := []string{tableName}
+	if view, _ := findView(databaseName, tableName); view != nil {
+		tables = append(tables, view.Table)
+	}
+	return tables
+}
+
+func tableGenerations(databaseName string, tables []string) (map[string]int64, error) {
+	all, err := loadGenerations(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	generations := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		generations[table] = generationOf(all, table)
+	}
+	return generations, nil
+}
+
+// generationOf retourne la génération d'une table ; une table jamais
+// modifiée depuis la dernière remise à zéro est à l'époque du fichier.
+func generationOf(generations map[string]int64, table string) int64 {
+	if generation, ok := generations[table]; ok {
+		return generation
+	}
+	return generations[generationsEpochKey]
+}
+
+func loadGenerations(databaseName string) (map[string]int64, error) {
+	generations := map[string]int64{}
+	content, err := os.ReadFile(fs.GetGenerationsFilePath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return generations, nil
+		}
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &generations); err != nil {
+			return resetGenerations(databaseName)
+		}
+	}
+	return generations, nil
+}
+
+// resetGenerations remplace generations.json quand il est illisible. Les
+// compteurs repartent d'une nouvelle époque, la date courante en
+// nanosecondes, supérieure à toute génération déjà attribuée : aucun
+// résultat en cache, dans ce processus ou un autre, ni aucune vue
+// matérialisée n'est plus validé par un ancien compteur.
+func resetGenerations(databaseName string) (map[string]int64, error) {
+	generations := map[string]int64{generationsEpochKey: time.Now().UnixNano()}
+	content, err := json.MarshalIndent(generations, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(fs.GetGenerationsFilePath(databaseName), content); err != nil {
+		return nil, err
+	}
+	return generations, nil
+}
+
+func mapKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
 }
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// CacheCounters compte les événements du cache des sélections. Une
+// invalidation est un résultat écarté parce qu'une table lue a été
+// modifiée ; une éviction, un résultat retiré pour respecter les limites
+// ou arrivé à expiration.
+type CacheCounters struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+// CacheStats regroupe les compteurs d'une base, au total et par table.
+type CacheStats struct {
+	CacheCounters
+	Entries int                       `json:"entries"`
+	Bytes   int64                     `json:"bytes"`
+	Tables  map[string]*CacheCounters `json:"tables,omitempty"`
+}
+
+// CacheEntryInfo décrit une entrée du cache disque pour `cache list`.
+type CacheEntryInfo struct {
+	Table     string            `json:"table"`
+	Where     map[string]string `json:"where"`
+	Rows      int               `json:"rows"`
+	Size      int64             `json:"size"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at,omitempty"`
+	LastUsed  time.Time         `json:"last_used"`
+}
+
+func (c *CacheCounters) HitRate() float64 {
+	if c.Hits+c.Misses == 0 {
+		return 0
+	}
+	return float64(c.Hits) / float64(c.Hits+c.Misses) * 100
+}
+
+// GetCacheStats retourne les compteurs du cache de la base ainsi que le
+// nombre et la taille des entrées sur disque.
+func GetCacheStats(databaseName string) (*CacheStats, error) {
+	counters, err := loadCacheCounters(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	stats := &CacheStats{Tables: counters}
+	for _, c := range counters {
+		stats.Hits += c.Hits
+		stats.Misses += c.Misses
+		stats.Evictions += c.Evictions
+		stats.Invalidations += c.Invalidations
+	}
+	entries, err := ListCacheEntries(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	stats.Entries = len(entries)
+	for _, entry := range entries {
+		stats.Bytes += entry.Size
+	}
+	return stats, nil
+}
+
+// ListCacheEntries liste les entrées du cache disque, de la plus récemment
+// utilisée à la plus ancienne.
+func ListCacheEntries(databaseName string) ([]CacheEntryInfo, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	files, err := os.ReadDir(fs.GetCacheDirPath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []CacheEntryInfo{}, nil
+		}
+		return nil, err
+	}
+	infos := []CacheEntryInfo{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		entry := diskGet(databaseName, strings.TrimSuffix(file.Name(), ".json"))
+		if entry == nil {
+			continue
+		}
+		infos = append(infos, CacheEntryInfo{
+			Table:     entry.Query.Table,
+			Where:     entry.Query.Where,
+			Rows:      len(entry.Result),
+			Size:      info.Size(),
+			CreatedAt: entry.CreatedAt,
+			ExpiresAt: entry.ExpiresAt,
+			LastUsed:  info.ModTime(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastUsed.After(infos[j].LastUsed)
+	})
+	return infos, nil
+}
+
+// ClearCache vide le cache de la base, ou seulement les résultats qui lisent
+// la table donnée, et retourne le nombre d'entrées supprimées.
+func ClearCache(databaseName, tableName string) (int, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return 0, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	entries, err := ListCacheEntries(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	if tableName == "" {
+		return len(entries), clearSelectCache(databaseName)
+	}
+
+	// Les résultats des vues construites sur la table sont écartés par la
+	// génération incrémentée ; on supprime directement ceux de la table.
+	if err := invalidateTables(databaseName, tableName); err != nil {
+		return 0, err
+	}
+	files, err := os.ReadDir(fs.GetCacheDirPath(databaseName))
+	if err != nil {
+		return 0, nil
+	}
+	removed := 0
+	for _, file := range files {
+		// Une clé sans préfixe, d'avant le nommage <table>_<hash>, peut
+		// lire n'importe quelle table.
+		key := strings.TrimSuffix(file.Name(), ".json")
+		if table := cacheKeyTable(key); table == tableName || table == "" {
+			removeCacheEntry(databaseName, key)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// WarmCache exécute la sélection pour la mettre en cache et retourne le
+// nombre de lignes lues.
+func WarmCache(databaseName, tableName string, whereClauses map[string]string) (int, error) {
+	rows, err := SelectDataRows(context.Background(), databaseName, tableName, whereClauses)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	if count > maxCachedRows {
+		return count, fmt.Errorf("%d lignes : le résultat dépasse %d lignes et n'est pas mis en cache", count, maxCachedRows)
+	}
+	return count, nil
+}
+
+// recordCacheEvent incrémente un compteur du cache pour la table. Les
+// compteurs sont enregistrés dans cache_stats.json.
+func recordCacheEvent(databaseName, tableName, event string, n int64) {
+	if n == 0 {
+		return
+	}
+	path := fs.GetCacheStatsFilePath(databaseName)
+	unlock, err := lockFile(path + ".lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	counters, err := loadCacheCounters(databaseName)
+	if err != nil {
+		counters = map[string]*CacheCounters{}
+	}
+	c := counters[tableName]
+	if c == nil {
+		c = &CacheCounters{}
+		counters[tableName] = c
+	}
+	switch event {
+	case "hit":
+		c.Hits += n
+	case "miss":
+		c.Misses += n
+	case "eviction":
+		c.Evictions += n
+	case "invalidation":
+		c.Invalidations += n
+	}
+	content, err := json.MarshalIndent(counters, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	os.WriteFile(path, content, 0644)
+}
+
+func loadCacheCounters(databaseName string) (map[string]*CacheCounters, error) {
+	counters := map[string]*CacheCounters{}
+	content, err := os.ReadFile(fs.GetCacheStatsFilePath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return counters, nil
+		}
+		return nil, err
+	}
+	if len(content) == 0 {
+		return counters, nil
+	}
+	if err := json.Unmarshal(content, &counters); err != nil {
+		return nil, fmt.Errorf("cache_stats.json mal formé : %v", err)
+	}
+	return counters, nil
+}
@@ -0,0 +1,440 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// cursorBatchSize est le nombre d'entrées du dossier de la table lues à la
+// fois lors d'un parcours complet.
+const cursorBatchSize = 256
+
+// maxCachedRows est le nombre de lignes au-delà duquel un résultat lu par
+// SelectDataRows n'est plus mis en cache.
+const maxCachedRows = 1000
+
+// Rows est un curseur sur le résultat d'une requête. Les lignes sont lues
+// une à une depuis le disque : seule la ligne courante est gardée en mémoire.
+//
+//	rows, err := QueryRows(ctx, query)
+//	defer rows.Close()
+//	for rows.Next() {
+//		entry := rows.Row()
+//	}
+//	err = rows.Err()
+type Rows struct {
+	ctx        context.Context
+	query      Query
+	plan       *Plan
+	types      map[string]string
+	stemming   map[string]bool
+	columns    []string
+	conditions []Condition
+	expiry     rowExpiry
+	expiredIDs []string
+
+	// snapshot fixe les versions lues. Les lignes qui ont des versions
+	// remplacées à l'ouverture (afterScan) sont écartées du parcours
+	// (deferred) puis lues une seule fois après lui.
+	snapshot    *Snapshot
+	ownSnapshot bool
+	deferred    map[string]bool
+	afterScan   []string
+
+	dir       *os.File
+	batch     []string
+	ids       []string
+	preloaded []map[string]string
+
+	current map[string]string
+	err     error
+	closed  bool
+	start   time.Time
+
+	fromCache bool
+	cacheKey  *SelectQuery
+	cacheGens map[string]int64
+	cacheRows []map[string]string
+}
+
+// QueryRows ouvre un curseur sur la requête, exécutée selon le plan retourné
+// par PlanQuery. Le parcours s'arrête dès que ctx est annulé.
+func QueryRows(ctx context.Context, query Query) (*Rows, error) {
+	start := time.Now()
+	plan, err := PlanQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	return openRows(ctx, plan, start)
+}
+
+// openRows ouvre un curseur qui suit le plan : parcours du résultat d'une vue
+// matérialisée, des ids retenus par un index ou du dossier de la table.
+func openRows(ctx context.Context, plan *Plan, start time.Time) (*Rows, error) {
+	query := plan.query
+	schema, err := loadSchema(query.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := &Rows{ctx: ctx, plan: plan, start: start, query: query, conditions: query.Conditions}
+	if plan.Kind == "materialized_view" {
+		view, err := findView(query.DBName, plan.Index)
+		if err != nil {
+			return nil, err
+		}
+		if view == nil {
+			return nil, fmt.Errorf("la vue \"%s\" n'existe pas", plan.Index)
+		}
+		if err := refreshIfStale(query.DBName, view); err != nil {
+			return nil, err
+		}
+		rows.preloaded, err = readMaterialized(query.DBName, view)
+		if err != nil {
+			return nil, err
+		}
+		rows.types = fieldTypes(schema[view.Table])
+		rows.columns = columnNames(schema[view.Table])
+		return rows, nil
+	}
+
+	rows.types = fieldTypes(schema[rows.query.Table])
+	rows.columns = columnNames(schema[rows.query.Table])
+	if rows.expiry, err = tableExpiry(rows.query.DBName, rows.query.Table); err != nil {
+		return nil, err
+	}
+	rows.stemming = map[string]bool{}
+	for _, cond := range rows.conditions {
+		if cond.Op != "MATCH" {
+			continue
+		}
+		if idx, _ := loadIndex(rows.query.DBName, rows.query.Table, cond.Field); idx != nil && idx.Kind == "fulltext" {
+			rows.stemming[cond.Field] = idx.Stemming
+		}
+	}
+
+	if err := rows.openSnapshot(); err != nil {
+		return nil, err
+	}
+
+	if plan.Kind != "full_scan" {
+		rows.ids = plan.ids
+		return rows, nil
+	}
+	dir, err := os.Open(fs.GetDataFilePath(rows.query.DBName, rows.query.Table))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rows, nil
+		}
+		rows.Close()
+		return nil, fmt.Errorf("impossible de lire le dossier table: %v", err)
+	}
+	rows.dir = dir
+	return rows, nil
+}
+
+// openSnapshot fixe l'instantané lu par le curseur : celui de la requête
+// (transaction) ou un instantané pris à l'ouverture et libéré par Close.
+// Une ligne modifiée ou effacée depuis l'instantané peut avoir disparu du
+// dossier ou de l'index : les lignes qui ont des versions remplacées à
+// l'ouverture sont lues après le parcours, qui garde ainsi une mémoire
+// bornée par leur nombre. Une ligne modifiée pendant le parcours est
+// résolue à sa lecture ; une ligne effacée pendant le parcours avant d'être
+// atteinte n'est pas retournée.
+func (r *Rows) openSnapshot() error {
+	if r.query.latest {
+		return nil
+	}
+	r.snapshot = r.query.snapshot
+	if r.snapshot == nil {
+		snapshot, err := TakeSnapshot(r.query.DBName)
+		if err != nil {
+			return err
+		}
+		r.snapshot, r.ownSnapshot = snapshot, true
+	}
+	ids, err := versionIDs(r.query.DBName, r.query.Table)
+	if err != nil {
+		return err
+	}
+	r.deferred = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		r.deferred[id] = true
+	}
+	r.afterScan = ids
+	return nil
+}
+
+// SelectDataRows est la version curseur de SelectData : un résultat présent
+// dans le cache est relu depuis le cache, sinon les lignes sont lues depuis
+// la table et le résultat n'est mis en cache que s'il reste sous
+// maxCachedRows lignes.
+func SelectDataRows(ctx context.Context, databaseName, tableName string, whereClauses map[string]string) (*Rows, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	key := SelectQuery{DBName: databaseName, Table: tableName, Where: whereClauses}
+	cached, found, err := GetCachedSelectResult(key)
+	if err != nil {
+		return nil, fmt.Errorf("erreur lors de la lecture du cache : %v", err)
+	}
+
+	query := Query{DBName: databaseName, Table: tableName, Conditions: equalityConditions(whereClauses)}
+	generations, err := tableGenerations(databaseName, cacheTables(databaseName, tableName))
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		schema, err := loadSchema(databaseName)
+		if err != nil {
+			return nil, err
+		}
+		expiry, err := tableExpiry(databaseName, tableName)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{
+			ctx:       ctx,
+			query:     query,
+			plan:      &Plan{Kind: "cache"},
+			columns:   columnNames(schema[tableName]),
+			expiry:    expiry,
+			preloaded: cached,
+			start:     time.Now(),
+			fromCache: true,
+		}, nil
+	}
+
+	rows, err := QueryRows(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	rows.cacheKey = &key
+	rows.cacheGens = generations
+	rows.cacheRows = []map[string]string{}
+	return rows, nil
+}
+
+// Next avance sur la ligne suivante. Il retourne false à la fin du résultat,
+// en cas d'erreur ou si le contexte est annulé ; Err indique alors la cause.
+func (r *Rows) Next() bool {
+	if r.closed {
+		return false
+	}
+	for {
+		if err := r.ctx.Err(); err != nil {
+			r.err = err
+			r.Close()
+			return false
+		}
+
+		entry, ok, err := r.nextCandidate()
+		if err != nil {
+			r.err = err
+			r.Close()
+			return false
+		}
+		if !ok {
+			r.finish()
+			return false
+		}
+		if r.expiry.enabled() && r.expiry.expired(entry, time.Now()) {
+			r.expiredIDs = append(r.expiredIDs, entry["id"])
+			continue
+		}
+		if !r.fromCache && !matchesConditions(entry, r.conditions, r.types, r.stemming) {
+			continue
+		}
+		if isDeleted(entry) && !r.query.IncludeDeleted {
+			continue
+		}
+
+		r.current = publicRow(entry)
+		r.plan.ActualRows++
+		if r.cacheRows != nil {
+			r.cacheRows = append(r.cacheRows, r.current)
+			if len(r.cacheRows) > maxCachedRows {
+				r.cacheRows = nil
+			}
+		}
+		return true
+	}
+}
+
+func (r *Rows) nextCandidate() (map[string]string, bool, error) {
+	if r.preloaded != nil {
+		if len(r.preloaded) == 0 {
+			return nil, false, nil
+		}
+		entry := r.preloaded[0]
+		r.preloaded = r.preloaded[1:]
+		r.plan.ScannedRows++
+		return entry, true, nil
+	}
+
+	for {
+		id, ok, err := r.nextID()
+		if err != nil || !ok {
+			return nil, false, err
+		}
+		entry, err := readRow(r.query.DBName, r.query.Table, id)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+		if r.snapshot != nil {
+			if entry, err = r.snapshot.resolve(r.query.Table, id, entry); err != nil {
+				return nil, false, err
+			}
+		}
+		if entry == nil {
+			continue
+		}
+		r.plan.ScannedRows++
+		return entry, true, nil
+	}
+}
+
+func (r *Rows) nextID() (string, bool, error) {
+	for {
+		id, ok, err := r.nextScanID()
+		if err != nil {
+			return "", false, err
+		}
+		if !ok {
+			break
+		}
+		if !r.deferred[id] {
+			return id, true, nil
+		}
+	}
+	if len(r.afterScan) == 0 {
+		return "", false, nil
+	}
+	id := r.afterScan[0]
+	r.afterScan = r.afterScan[1:]
+	return id, true, nil
+}
+
+func (r *Rows) nextScanID() (string, bool, error) {
+	if r.dir == nil {
+		if len(r.ids) == 0 {
+			return "", false, nil
+		}
+		id := r.ids[0]
+		r.ids = r.ids[1:]
+		return id, true, nil
+	}
+
+	for len(r.batch) == 0 {
+		files, err := r.dir.ReadDir(cursorBatchSize)
+		if len(files) == 0 {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return "", false, fmt.Errorf("impossible de lire le dossier table: %v", err)
+			}
+			r.dir.Close()
+			r.dir = nil
+			return "", false, nil
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+				continue
+			}
+			r.batch = append(r.batch, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	id := r.batch[0]
+	r.batch = r.batch[1:]
+	return id, true, nil
+}
+
+// finish termine un parcours complet : le plan est complété, le résultat
+// mis en cache s'il a été demandé par SelectDataRows et les lignes expirées
+// rencontrées sont effacées.
+func (r *Rows) finish() {
+	r.plan.Analyzed = true
+	r.plan.Duration = time.Since(r.start)
+	if r.cacheKey != nil && r.cacheRows != nil {
+		saveSelectCache(*r.cacheKey, r.cacheRows, r.cacheGens)
+	}
+	if len(r.expiredIDs) > 0 {
+		sweepExpired(r.query.DBName, r.query.Table, r.expiredIDs)
+	}
+	r.Close()
+}
+
+// Row retourne la ligne courante.
+func (r *Rows) Row() map[string]string {
+	return r.current
+}
+
+// Columns retourne les colonnes de la table dans l'ordre du schéma, id en
+// premier. C'est l'ordre utilisé par Scan.
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// Scan copie les valeurs de la ligne courante dans dest, dans l'ordre de
+// Columns.
+func (r *Rows) Scan(dest ...*string) error {
+	if r.current == nil {
+		return fmt.Errorf("aucune ligne courante : appelez Next avant Scan")
+	}
+	if len(dest) != len(r.columns) {
+		return fmt.Errorf("Scan attend %d valeurs, %d fournies", len(r.columns), len(dest))
+	}
+	for i, column := range r.columns {
+		*dest[i] = r.current[column]
+	}
+	return nil
+}
+
+// Err retourne l'erreur qui a interrompu le parcours, le cas échéant.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// FromCache indique si les lignes proviennent du cache des sélections.
+func (r *Rows) FromCache() bool {
+	return r.fromCache
+}
+
+// Plan retourne le plan d'exécution, complété des compteurs une fois le
+// parcours terminé.
+func (r *Rows) Plan() *Plan {
+	return r.plan
+}
+
+// Close libère le curseur. Il peut être appelé plusieurs fois.
+func (r *Rows) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.current = nil
+	r.preloaded, r.ids, r.batch = nil, nil, nil
+	r.deferred, r.afterScan = nil, nil
+	if r.ownSnapshot {
+		r.snapshot.Release()
+	}
+	if r.dir != nil {
+		return r.dir.Close()
+	}
+	return nil
+}
+
+func columnNames(fields []string) []string {
+	columns := []string{"id"}
+	for _, field := range fields {
+		name := strings.TrimSpace(strings.Split(field, ":")[0])
+		if name != "id" {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
@@ -2,14 +2,15 @@ package database
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"github.com/fabian222222/lib-db/pkg/fs"
 	"github.com/lucsky/cuid"
 	"path/filepath"
-	"io/ioutil"
 )
 
 func InsertData(databaseName, tableName string, rawInputs ...map[string]string) error {
@@ -85,19 +86,21 @@ func InsertData(databaseName, tableName string, rawInputs ...map[string]string)
 			entry[field] = val
 		}
 
-		data, err := json.MarshalIndent(entry, "", "  ")
+		// Le verrou ordonne l'insertion avec UpsertData, qui cherche les
+		// conflits sous ce même verrou.
+		unlock, err := lockTable(databaseName, tableName)
 		if err != nil {
 			return err
 		}
-
 		SaveQueryToCache(CachedQuery{
 			Action: "insert",
 			DBName: databaseName,
 			Table:  tableName,
 			Data:   entry,
 		})
-		filename := filepath.Join(tableDir, entry["id"]+".json")
-		if err := os.WriteFile(filename, data, 0644); err != nil {
+		err = writeRow(databaseName, tableName, nil, entry)
+		unlock()
+		if err != nil {
 			return err
 		}
 	}
@@ -106,6 +109,13 @@ func InsertData(databaseName, tableName string, rawInputs ...map[string]string)
 }
 
 func UpdateData(databaseName, tableName, targetID string, updates map[string]string) error {
+	return UpdateDataIfVersion(databaseName, tableName, targetID, 0, updates)
+}
+
+// UpdateDataIfVersion modifie une ligne comme UpdateData. expectedVersion,
+// si non nul, est la version (_version) que la ligne doit avoir ; sinon la
+// mise à jour échoue.
+func UpdateDataIfVersion(databaseName, tableName, targetID string, expectedVersion int64, updates map[string]string) error {
 	reader := bufio.NewReader(os.Stdin)
 
 	if databaseName == "" {
@@ -159,6 +169,7 @@ func UpdateData(databaseName, tableName, targetID string, updates map[string]str
 		return fmt.Errorf("Erreur de lecture du fichier JSON : %v", err)
 	}
 
+	values := map[string]string{}
 	for field := range validFields {
 		if field == "id" {
 			continue
@@ -174,6 +185,40 @@ func UpdateData(databaseName, tableName, targetID string, updates map[string]str
 		if val == "" {
 			continue
 		}
+		values[field] = val
+	}
+
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entry, err = readRow(databaseName, tableName, targetID)
+	if err != nil {
+		return fmt.Errorf("Erreur de lecture du fichier JSON : %v", err)
+	}
+	if isDeleted(entry) {
+		return fmt.Errorf("L'entrée avec ID \"%s\" est supprimée (data restore pour la récupérer)", targetID)
+	}
+	expired, err := isRowExpired(databaseName, tableName, entry)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return fmt.Errorf("L'entrée avec ID \"%s\" a expiré", targetID)
+	}
+	if err := checkVersion(entry, expectedVersion); err != nil {
+		return err
+	}
+	old := copyRow(entry)
+	types := fieldTypes(fields)
+
+	for field, expr := range values {
+		val, err := evalUpdateExpr(field, expr, old, types)
+		if err != nil {
+			return fmt.Errorf("Expression invalide pour \"%s\" : %v", field, err)
+		}
 
 		if strings.HasSuffix(field, "_id") {
 			relatedTable := strings.TrimSuffix(field, "_id")
@@ -190,12 +235,6 @@ func UpdateData(databaseName, tableName, targetID string, updates map[string]str
 		entry[field] = val
 	}
 
-	updatedJSON, err := json.MarshalIndent(entry, "", "  ")
-	if err != nil {
-		return err
-	}
-
-
 	SaveQueryToCache(CachedQuery{
 		Action: "update",
 		DBName: databaseName,
@@ -203,7 +242,7 @@ func UpdateData(databaseName, tableName, targetID string, updates map[string]str
 		Data:   entry,
 	})
 
-	if err := os.WriteFile(dataFile, updatedJSON, 0644); err != nil {
+	if err := writeRow(databaseName, tableName, old, entry); err != nil {
 		return fmt.Errorf("Erreur lors de l'écriture : %v", err)
 	}
 
@@ -212,6 +251,12 @@ func UpdateData(databaseName, tableName, targetID string, updates map[string]str
 }
 
 func DeleteData(databaseName, tableName, id string) error {
+	return DeleteDataIfVersion(databaseName, tableName, id, 0)
+}
+
+// DeleteDataIfVersion supprime une ligne, comme UpdateDataIfVersion pour
+// expectedVersion.
+func DeleteDataIfVersion(databaseName, tableName, id string, expectedVersion int64) error {
 	if databaseName == "" {
 		return fmt.Errorf("le nom de la base de données ne peut pas être vide")
 	}
@@ -232,6 +277,30 @@ func DeleteData(databaseName, tableName, id string) error {
 		return fmt.Errorf("l'entrée avec l'id \"%s\" n'existe pas dans la table \"%s\"", id, tableName)
 	}
 
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := readRow(databaseName, tableName, id)
+	if err != nil {
+		return err
+	}
+	if isDeleted(old) {
+		return fmt.Errorf("l'entrée avec l'id \"%s\" est déjà supprimée (data restore pour la récupérer)", id)
+	}
+	expired, err := isRowExpired(databaseName, tableName, old)
+	if err != nil {
+		return err
+	}
+	if expired {
+		return fmt.Errorf("l'entrée avec l'id \"%s\" a expiré", id)
+	}
+	if err := checkVersion(old, expectedVersion); err != nil {
+		return err
+	}
+
 	SaveQueryToCache(CachedQuery{
 		Action: "delete",
 		DBName: databaseName,
@@ -239,8 +308,7 @@ func DeleteData(databaseName, tableName, id string) error {
 		Data:   map[string]string{"id": id},
 	})
 
-	err := os.Remove(filePath)
-	if err != nil {
+	if err := deleteRow(databaseName, tableName, old); err != nil {
 		return fmt.Errorf("erreur lors de la suppression de l'entrée : %v", err)
 	}
 
@@ -248,6 +316,8 @@ func DeleteData(databaseName, tableName, id string) error {
 	return nil
 }
 
+// SelectData retourne les lignes dont les champs valent whereClauses. Un
+// champ absent du schéma est une erreur (voir PlanQuery).
 func SelectData(databaseName, tableName string, whereClauses map[string]string) ([]map[string]string, error) {
 	if databaseName == "" {
 		return nil, fmt.Errorf("le nom de la base de données ne peut pas être vide")
@@ -260,62 +330,134 @@ func SelectData(databaseName, tableName string, whereClauses map[string]string)
 		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
 	}
 
-	query := SelectQuery{
-		DBName: databaseName,
-		Table:  tableName,
-		Where:  whereClauses,
-	}
-
-	cachedResults, found, err := GetCachedSelectResult(query)
+	rows, err := SelectDataRows(context.Background(), databaseName, tableName, whereClauses)
 	if err != nil {
-		return nil, fmt.Errorf("erreur lors de la lecture du cache : %v", err)
+		return nil, err
 	}
-	if found {
+	defer rows.Close()
+	if rows.FromCache() {
 		fmt.Println("Résultat récupéré depuis le cache.")
-		return cachedResults, nil
 	}
 
-	tablePath := fs.GetDataFilePath(databaseName, tableName)
-
 	matchingEntries := []map[string]string{}
+	for rows.Next() {
+		matchingEntries = append(matchingEntries, rows.Row())
+	}
+	return matchingEntries, rows.Err()
+}
+
+// SelectRange retourne les lignes dont le champ est compris entre min et max
+// (bornes incluses, une borne vide n'est pas limitée).
+func SelectRange(databaseName, tableName, fieldName, min, max string) ([]map[string]string, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	conditions := []Condition{}
+	if min != "" {
+		conditions = append(conditions, Condition{Field: fieldName, Op: ">=", Value: min})
+	}
+	if max != "" {
+		conditions = append(conditions, Condition{Field: fieldName, Op: "<=", Value: max})
+	}
+	return SelectWhere(Query{
+		DBName:     databaseName,
+		Table:      tableName,
+		Conditions: conditions,
+	})
+}
 
-	files, err := ioutil.ReadDir(tablePath)
+func readRow(databaseName, tableName, id string) (map[string]string, error) {
+	content, err := os.ReadFile(fs.GetDataFile(databaseName, tableName, id))
 	if err != nil {
-		return nil, fmt.Errorf("impossible de lire le dossier table: %v", err)
+		return nil, err
+	}
+	var entry map[string]string
+	if err := json.Unmarshal(content, &entry); err != nil {
+		return nil, fmt.Errorf("erreur d'unmarshal JSON dans %s.json: %v", id, err)
 	}
+	return entry, nil
+}
 
-	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
-			continue
-		}
+// writeRow écrit la ligne entry sur le disque puis met à jour les index et
+// l'historique de la table. old contient la version précédente de la ligne, nil pour une insertion.
+func writeRow(databaseName, tableName string, old, entry map[string]string) error {
+	return withCommit(databaseName, func(seq int64) error {
+		return writeRowAt(databaseName, tableName, old, entry, seq)
+	})
+}
 
-		filePath := filepath.Join(tablePath, file.Name())
-		dataBytes, err := ioutil.ReadFile(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("impossible de lire le fichier %s: %v", file.Name(), err)
-		}
+// writeRowAt écrit la ligne dans la validation seq (voir mvcc.go).
+func writeRowAt(databaseName, tableName string, old, entry map[string]string, seq int64) error {
+	stampVersion(old, entry)
+	return writeImageAt(databaseName, tableName, old, entry, seq)
+}
 
-		var entry map[string]string
-		err = json.Unmarshal(dataBytes, &entry)
-		if err != nil {
-			return nil, fmt.Errorf("erreur d'unmarshal JSON dans %s: %v", file.Name(), err)
-		}
+// writeImageAt écrit une image exacte de la ligne, version comprise :
+// annulation ou rejeu d'un journal.
+func writeImageAt(databaseName, tableName string, old, entry map[string]string, seq int64) error {
+	if err := stampExpiry(databaseName, tableName, old, entry); err != nil {
+		return err
+	}
+	if err := keepVersion(databaseName, tableName, entry["id"], seq); err != nil {
+		return err
+	}
+	entry[xminField] = strconv.FormatInt(seq, 10)
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fs.GetDataFile(databaseName, tableName, entry["id"]), data); err != nil {
+		return err
+	}
+	if err := updateIndexes(databaseName, tableName, old, entry); err != nil {
+		return err
+	}
+	if err := recordHistory(databaseName, tableName, "", old, entry); err != nil {
+		return err
+	}
+	if err := invalidateTables(databaseName, tableName); err != nil {
+		return err
+	}
+	publishChange(databaseName, tableName, "", old, entry)
+	return nil
+}
 
-		match := true
-		for k, v := range whereClauses {
-			val, ok := entry[k]
-			if !ok || val != v {
-				match = false
-				break
-			}
-		}
+func removeRow(databaseName, tableName string, old map[string]string) error {
+	return dropRow(databaseName, tableName, "", old)
+}
 
-		if match {
-			matchingEntries = append(matchingEntries, entry)
-		}
-	}
+// dropRow efface le fichier d'une ligne ; op nomme l'opération dans
+// l'historique et les notifications (suppression par défaut).
+func dropRow(databaseName, tableName, op string, old map[string]string) error {
+	return withCommit(databaseName, func(seq int64) error {
+		return dropRowAt(databaseName, tableName, op, old, seq)
+	})
+}
 
-	SaveSelectCache(query, matchingEntries)
+func dropRowAt(databaseName, tableName, op string, old map[string]string, seq int64) error {
+	if err := keepVersion(databaseName, tableName, old["id"], seq); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.GetDataFile(databaseName, tableName, old["id"])); err != nil {
+		return err
+	}
+	if err := updateIndexes(databaseName, tableName, old, nil); err != nil {
+		return err
+	}
+	if err := recordHistory(databaseName, tableName, op, old, nil); err != nil {
+		return err
+	}
+	if err := invalidateTables(databaseName, tableName); err != nil {
+		return err
+	}
+	publishChange(databaseName, tableName, op, old, nil)
+	return nil
+}
 
-	return matchingEntries, nil
+func copyRow(entry map[string]string) map[string]string {
+	copied := make(map[string]string, len(entry))
+	for k, v := range entry {
+		copied[k] = v
+	}
+	return copied
 }
@@ -37,7 +37,7 @@ func CreateDatabase(name string) {
     fmt.Println("Database", name, "created at", dbPath)
 	fs.CreateFile(name, "schema.txt")
 	fs.CreateDir(name, "data")
-	fs.CreateFile(name, "cache.txt")
+	fs.CreateDir(name, "cache")
 	fs.CreateFile(name, "pending.txt")
 	
 	err = GrantDatabaseAccess(session.Username, name)
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// expiresAtField contient la date d'expiration d'une ligne d'une table avec
+// un ttl (table set <db> <table> ttl 1h). Elle est fixée à l'insertion et
+// n'est pas modifiée par les mises à jour.
+const expiresAtField = "_expires_at"
+
+// rowExpiry décrit l'expiration des lignes d'une table : un ttl, un champ
+// datetime (expires_field), ou les deux.
+type rowExpiry struct {
+	ttl   time.Duration
+	field string
+}
+
+func tableExpiry(databaseName, tableName string) (rowExpiry, error) {
+	settings, err := GetTableSettings(databaseName, tableName)
+	if err != nil {
+		return rowExpiry{}, err
+	}
+	expiry := rowExpiry{field: settings.ExpiresField}
+	if settings.TTL != "" {
+		if expiry.ttl, err = ParseRetention(settings.TTL); err != nil {
+			return rowExpiry{}, err
+		}
+	}
+	return expiry, nil
+}
+
+func (e rowExpiry) enabled() bool {
+	return e.ttl > 0 || e.field != ""
+}
+
+// expired indique si la ligne a expiré à l'instant now. Une date vide ou
+// illisible n'expire pas.
+func (e rowExpiry) expired(row map[string]string, now time.Time) bool {
+	values := []string{}
+	if e.ttl > 0 {
+		values = append(values, row[expiresAtField])
+	}
+	if e.field != "" {
+		values = append(values, row[e.field])
+	}
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		if t, err := ParseTimestamp(value); err == nil && !now.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// stampExpiry fixe la date d'expiration d'une ligne insérée, ou qui en
+// remplace une autre qui en avait une (upsert d'une ligne expirée).
+func stampExpiry(databaseName, tableName string, old, entry map[string]string) error {
+	if entry[expiresAtField] != "" || (old != nil && old[expiresAtField] == "") {
+		return nil
+	}
+	expiry, err := tableExpiry(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	if expiry.ttl > 0 {
+		entry[expiresAtField] = time.Now().Add(expiry.ttl).Format(time.RFC3339)
+	}
+	return nil
+}
+
+// isRowExpired indique si une ligne de la table a expiré.
+func isRowExpired(databaseName, tableName string, row map[string]string) (bool, error) {
+	expiry, err := tableExpiry(databaseName, tableName)
+	if err != nil {
+		return false, err
+	}
+	return expiry.expired(row, time.Now()), nil
+}
+
+// ExpireRows efface les lignes expirées de la table et retourne leurs ids.
+// Chaque suppression est enregistrée comme "expire" dans l'historique et
+// publiée sur changes:<table>.
+func ExpireRows(databaseName, tableName string) ([]string, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	expiry, err := tableExpiry(databaseName, tableName)
+	if err != nil || !expiry.enabled() {
+		return []string{}, err
+	}
+	if _, err := os.Stat(fs.GetDataFilePath(databaseName, tableName)); os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	ids, err := listRowIDs(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return expireIDs(databaseName, tableName, expiry, ids)
+}
+
+// sweepExpired efface les lignes expirées repérées pendant une lecture, si
+// la table n'est pas verrouillée : une écriture en cours les effacera plus
+// tard.
+func sweepExpired(databaseName, tableName string, ids []string) {
+	unlock, ok := tryLockTable(databaseName, tableName)
+	if !ok {
+		return
+	}
+	defer unlock()
+	expiry, err := tableExpiry(databaseName, tableName)
+	if err != nil {
+		return
+	}
+	expireIDs(databaseName, tableName, expiry, ids)
+}
+
+// expireIDs relit chaque ligne sous le verrou et l'efface si elle a expiré.
+func expireIDs(databaseName, tableName string, expiry rowExpiry, ids []string) ([]string, error) {
+	now := time.Now()
+	expired := []string{}
+	for _, id := range ids {
+		row, err := readRow(databaseName, tableName, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return expired, err
+		}
+		if !expiry.expired(row, now) {
+			continue
+		}
+		if err := dropRow(databaseName, tableName, "expire", row); err != nil {
+			return expired, err
+		}
+		expired = append(expired, id)
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// StartRowExpiry efface périodiquement les lignes expirées des tables de la
+// base jusqu'à l'annulation du contexte.
+func StartRowExpiry(ctx context.Context, databaseName string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				settings, err := loadSettings(databaseName)
+				if err != nil {
+					continue
+				}
+				for tableName, table := range settings.Tables {
+					if table.TTL != "" || table.ExpiresField != "" {
+						ExpireRows(databaseName, tableName)
+					}
+				}
+			}
+		}
+	}()
+}
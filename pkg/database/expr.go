@@ -0,0 +1,193 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var updateFunctions = map[string]bool{
+	"upper":  true,
+	"lower":  true,
+	"trim":   true,
+	"concat": true,
+	"append": true,
+}
+
+// exprMarker préfixe les valeurs construites par Expr. Une valeur sans ce
+// préfixe est toujours enregistrée telle quelle.
+const exprMarker = "\x00expr:"
+
+// Expr marque expr comme une expression à évaluer sur la ligne courante
+// (voir evalUpdateExpr) dans UpdateData, UpdateWhere, UpsertData et
+// Tx.Update.
+func Expr(expr string) string {
+	return exprMarker + expr
+}
+
+// ParseAssignment lit une affectation de la forme champ=expression et
+// retourne l'expression marquée par Expr. Les formes raccourcies champ+=n,
+// champ-=n, champ*=n et champ/=n sont réécrites en champ=champ+n, etc.
+func ParseAssignment(pair string) (string, string, bool) {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", false
+	}
+	field, expr := parts[0], parts[1]
+	if last := field[len(field)-1]; strings.ContainsRune("+-*/", rune(last)) {
+		field = strings.TrimSpace(field[:len(field)-1])
+		expr = field + string(last) + expr
+	}
+	return strings.TrimSpace(field), Expr(expr), true
+}
+
+// literalValue retourne le texte d'une valeur, sans la marque d'expression.
+func literalValue(value string) string {
+	return strings.TrimPrefix(value, exprMarker)
+}
+
+// evalUpdateExpr calcule la nouvelle valeur de field à partir de expr et de
+// la ligne courante. Sont reconnus, pour un champ int ou float,
+// l'arithmétique sur un champ numérique (stock-1, price*1.2) et, pour tout
+// champ, les fonctions upper, lower, trim, concat et append
+// (liste séparée par des virgules). Seules les valeurs marquées par Expr sont
+// évaluées ; toute autre valeur est prise telle quelle.
+func evalUpdateExpr(field, value string, entry map[string]string, types map[string]string) (string, error) {
+	if !strings.HasPrefix(value, exprMarker) {
+		return value, nil
+	}
+	expr := literalValue(value)
+	trimmed := strings.TrimSpace(expr)
+
+	if open := strings.Index(trimmed, "("); open > 0 && strings.HasSuffix(trimmed, ")") {
+		name := strings.ToLower(strings.TrimSpace(trimmed[:open]))
+		if updateFunctions[name] {
+			args, err := evalFunctionArgs(trimmed[open+1:len(trimmed)-1], entry, types)
+			if err != nil {
+				return "", err
+			}
+			return applyUpdateFunction(name, args)
+		}
+	}
+
+	if resultType := types[field]; resultType != "int" && resultType != "float" {
+		return expr, nil
+	}
+	for _, op := range []string{"+", "-", "*", "/"} {
+		idx := strings.Index(trimmed, op)
+		if idx <= 0 {
+			continue
+		}
+		operand := strings.TrimSpace(trimmed[:idx])
+		fieldType, ok := types[operand]
+		if !ok || (fieldType != "int" && fieldType != "float") {
+			continue
+		}
+		return evalArithmetic(entry[operand], op, strings.TrimSpace(trimmed[idx+1:]), types[field])
+	}
+
+	return expr, nil
+}
+
+func evalArithmetic(current, op, operand, resultType string) (string, error) {
+	if current == "" {
+		current = "0"
+	}
+	if resultType == "int" {
+		x, err := strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("valeur entière invalide : \"%s\"", current)
+		}
+		y, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("opérande entier invalide : \"%s\"", operand)
+		}
+		switch op {
+		case "+":
+			return strconv.FormatInt(x+y, 10), nil
+		case "-":
+			return strconv.FormatInt(x-y, 10), nil
+		case "*":
+			return strconv.FormatInt(x*y, 10), nil
+		}
+		if y == 0 {
+			return "", fmt.Errorf("division par zéro")
+		}
+		return strconv.FormatInt(x/y, 10), nil
+	}
+
+	x, err := strconv.ParseFloat(current, 64)
+	if err != nil {
+		return "", fmt.Errorf("valeur numérique invalide : \"%s\"", current)
+	}
+	y, err := strconv.ParseFloat(operand, 64)
+	if err != nil {
+		return "", fmt.Errorf("opérande numérique invalide : \"%s\"", operand)
+	}
+	var result float64
+	switch op {
+	case "+":
+		result = x + y
+	case "-":
+		result = x - y
+	case "*":
+		result = x * y
+	case "/":
+		if y == 0 {
+			return "", fmt.Errorf("division par zéro")
+		}
+		result = x / y
+	}
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+// evalFunctionArgs résout les arguments d'une fonction : un nom de champ
+// est remplacé par sa valeur, un texte entre quotes par son contenu.
+func evalFunctionArgs(raw string, entry map[string]string, types map[string]string) ([]string, error) {
+	args := []string{}
+	for _, arg := range strings.Split(raw, ",") {
+		arg = strings.TrimSpace(arg)
+		if len(arg) >= 2 && (arg[0] == '\'' || arg[0] == '"') && arg[len(arg)-1] == arg[0] {
+			args = append(args, arg[1:len(arg)-1])
+			continue
+		}
+		if _, ok := types[arg]; ok {
+			args = append(args, entry[arg])
+			continue
+		}
+		if _, err := strconv.ParseFloat(arg, 64); err == nil {
+			args = append(args, arg)
+			continue
+		}
+		return nil, fmt.Errorf("argument inconnu : \"%s\" (champ ou texte entre quotes attendu)", arg)
+	}
+	return args, nil
+}
+
+func applyUpdateFunction(name string, args []string) (string, error) {
+	switch name {
+	case "upper", "lower", "trim":
+		if len(args) != 1 {
+			return "", fmt.Errorf("%s attend un argument", name)
+		}
+		if name == "upper" {
+			return strings.ToUpper(args[0]), nil
+		}
+		if name == "lower" {
+			return strings.ToLower(args[0]), nil
+		}
+		return strings.TrimSpace(args[0]), nil
+	case "concat":
+		return strings.Join(args, ""), nil
+	case "append":
+		if len(args) < 2 {
+			return "", fmt.Errorf("append attend une liste et au moins une valeur")
+		}
+		items := []string{}
+		if args[0] != "" {
+			items = strings.Split(args[0], ",")
+		}
+		return strings.Join(append(items, args[1:]...), ","), nil
+	}
+	return "", fmt.Errorf("fonction inconnue : %s", name)
+}
@@ -127,6 +127,7 @@ func AddField(databaseName, tableName, fieldName, fieldType string, showLogs boo
 		fmt.Println("erreur lors de l'écriture du fichier", err)
 		return
 	}
+	invalidateTables(databaseName, tableName)
 	if showLogs {
 		fmt.Printf("le champ \"%s\" a été ajouté à la table \"%s\"\n", fieldName, tableName)
 	}
@@ -218,7 +219,16 @@ func RemoveField(database string, tableName string, fieldName string, showLogs .
 		newLines = append(newLines, line)
 	}
 
-	return fs.WriteLines(path, newLines)
+	if err := fs.WriteLines(path, newLines); err != nil {
+		return err
+	}
+	if err := invalidateTables(database, tableName); err != nil {
+		return err
+	}
+	if idx, _ := loadIndex(database, tableName, fieldName); idx != nil {
+		return DropIndex(database, tableName, fieldName)
+	}
+	return nil
 }
 
 
@@ -306,11 +316,17 @@ func UpdateField(databaseName, tableName, fieldName, newType string, newOptions
 		return nil
 	}
 
+	idx, _ := loadIndex(databaseName, tableName, fieldName)
 	if err := RemoveField(databaseName, tableName, fieldName, false); err != nil {
 		fmt.Println("erreur lors de la suppression du champ", err)
 		return nil
 	}
 	AddField(databaseName, tableName, fieldName, newType, false, newOptions...)
+	if idx != nil {
+		if err := createIndex(databaseName, tableName, fieldName, idx.Kind, idx.Stemming); err != nil {
+			fmt.Println("erreur lors de la reconstruction de l'index", err)
+		}
+	}
 	fmt.Printf("le champ \"%s\" a été mis à jour dans la table \"%s\"\n", fieldName, tableName)
 	return nil
 }
@@ -323,14 +339,31 @@ func GetSchema(database string) (map[string][]string, error) {
 		database, _ = reader.ReadString('\n')
 		database = strings.TrimSpace(database)
 	}
-	path := fs.GetSchemaFilePath(database)
-
-	lines, err := fs.ReadLines(path)
+	schema, err := loadSchema(database)
 	if err != nil {
 		fmt.Println("La base de données n'existe pas")
 		return nil, err
 	}
 
+	fmt.Println("📘 Schéma de la base de données :", database)
+	fmt.Println("──────────────────────────────────────")
+	for table, fields := range schema {
+		fmt.Printf("📂 Table: %s\n", table)
+		for _, field := range fields {
+			fmt.Printf("   └─ %s\n", field)
+		}
+		fmt.Println()
+	}
+
+	return schema, nil
+}
+
+func loadSchema(database string) (map[string][]string, error) {
+	lines, err := fs.ReadLines(fs.GetSchemaFilePath(database))
+	if err != nil {
+		return nil, err
+	}
+
 	schema := make(map[string][]string)
 	var currentTable string
 	for _, line := range lines {
@@ -345,18 +378,19 @@ func GetSchema(database string) (map[string][]string, error) {
 			schema[currentTable] = append(schema[currentTable], trim)
 		}
 	}
+	return schema, nil
+}
 
-	fmt.Println("📘 Schéma de la base de données :", database)
-	fmt.Println("──────────────────────────────────────")
-	for table, fields := range schema {
-		fmt.Printf("📂 Table: %s\n", table)
-		for _, field := range fields {
-			fmt.Printf("   └─ %s\n", field)
+func fieldTypes(fields []string) map[string]string {
+	types := make(map[string]string)
+	for _, field := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) < 2 {
+			continue
 		}
-		fmt.Println()
+		types[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 	}
-
-	return schema, nil
+	return types
 }
 
 func ValidateFieldDefinition(def string) error {
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"github.com/fabian222222/lib-db/pkg/fs"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ligatureFolder remplace les ligatures, que la décomposition de foldAccents
+// laisse intactes.
+var ligatureFolder = strings.NewReplacer("œ", "oe", "æ", "ae")
+
+// Suffixes retirés par le stemming, du plus long au plus court. La liste
+// couvre les terminaisons françaises et anglaises les plus courantes.
+var stemSuffixes = []string{
+	"issements", "issement", "atrices", "ateurs", "ations", "ements",
+	"atrice", "ateur", "ation", "ement", "ments", "euses", "ment", "euse",
+	"ites", "ing", "ite", "eux", "es", "ed", "s", "x", "e",
+}
+
+type SearchResult struct {
+	Row   map[string]string `json:"row"`
+	Score float64           `json:"score"`
+}
+
+// Tokenize découpe un texte en mots en minuscules et sans accents. Avec
+// stemming, chaque mot est réduit à sa racine.
+func Tokenize(text string, stemming bool) []string {
+	text = foldAccents(strings.ToLower(text))
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if stemming {
+		for i, word := range words {
+			words[i] = stem(word)
+		}
+	}
+	return words
+}
+
+// foldAccents retire les accents : les lettres sont décomposées (NFD) puis
+// leurs marques combinantes supprimées. La chaîne de transformations garde
+// un état, elle est donc créée à chaque appel.
+func foldAccents(text string) string {
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		folded = text
+	}
+	return ligatureFolder.Replace(folded)
+}
+
+func stem(word string) string {
+	for _, suffix := range stemSuffixes {
+		if strings.HasSuffix(word, suffix) && len(word)-len(suffix) >= 3 {
+			return strings.TrimSuffix(word, suffix)
+		}
+	}
+	return word
+}
+
+func (idx *Index) addDocument(value, id string) {
+	if idx.Terms == nil {
+		idx.Terms = map[string]map[string]int{}
+	}
+	if idx.Docs == nil {
+		idx.Docs = map[string]int{}
+	}
+	if _, ok := idx.Docs[id]; ok {
+		return
+	}
+	tokens := Tokenize(value, idx.Stemming)
+	for _, token := range tokens {
+		if idx.Terms[token] == nil {
+			idx.Terms[token] = map[string]int{}
+		}
+		idx.Terms[token][id]++
+	}
+	idx.Docs[id] = len(tokens)
+}
+
+func (idx *Index) removeDocument(value, id string) {
+	for _, token := range Tokenize(value, idx.Stemming) {
+		delete(idx.Terms[token], id)
+		if len(idx.Terms[token]) == 0 {
+			delete(idx.Terms, token)
+		}
+	}
+	delete(idx.Docs, id)
+}
+
+// matchIDs retourne les ids des lignes contenant tous les mots de terms.
+func (idx *Index) matchIDs(terms string) []string {
+	tokens := Tokenize(terms, idx.Stemming)
+	if len(tokens) == 0 {
+		return []string{}
+	}
+	ids := []string{}
+	for id := range idx.Terms[tokens[0]] {
+		all := true
+		for _, token := range tokens[1:] {
+			if _, ok := idx.Terms[token][id]; !ok {
+				all = false
+				break
+			}
+		}
+		if all {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func matchesText(value, terms string, stemming bool) bool {
+	words := map[string]bool{}
+	for _, word := range Tokenize(value, stemming) {
+		words[word] = true
+	}
+	tokens := Tokenize(terms, stemming)
+	if len(tokens) == 0 {
+		return false
+	}
+	for _, token := range tokens {
+		if !words[token] {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchData retourne les lignes contenant tous les mots recherchés, comme
+// le filtre MATCH, classées par score TF-IDF décroissant. L'index fulltext du champ est
+// utilisé s'il existe, sinon les lignes sont analysées à la volée.
+func SearchData(databaseName, tableName, fieldName, terms string) ([]SearchResult, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := schema[tableName]
+	if !ok {
+		return nil, fmt.Errorf("la table \"%s\" n'existe pas", tableName)
+	}
+	if fieldType, ok := fieldTypes(fields)[fieldName]; !ok || fieldType != "string" {
+		return nil, fmt.Errorf("le champ \"%s\" n'est pas un champ string de la table \"%s\"", fieldName, tableName)
+	}
+
+	idx, err := loadIndex(databaseName, tableName, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	if idx == nil || idx.Kind != "fulltext" {
+		idx = &Index{Table: tableName, Field: fieldName, Kind: "fulltext", FieldType: "string"}
+		if err := idx.build(databaseName); err != nil {
+			return nil, err
+		}
+	}
+
+	scores := map[string]float64{}
+	totalDocs := float64(len(idx.Docs))
+	for _, token := range Tokenize(terms, idx.Stemming) {
+		postings := idx.Terms[token]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + totalDocs/float64(len(postings)))
+		for id, count := range postings {
+			scores[id] += float64(count) / float64(idx.Docs[id]) * idf
+		}
+	}
+
+	expiry, err := tableExpiry(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	results := []SearchResult{}
+	for _, id := range idx.matchIDs(terms) {
+		score := scores[id]
+		row, err := readRow(databaseName, tableName, id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if isDeleted(row) || expiry.expired(row, now) {
+			continue
+		}
+		results = append(results, SearchResult{Row: publicRow(row), Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Row["id"] < results[j].Row["id"]
+	})
+	return results, nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import "fmt"
+
+// globMatch compare s au motif comme Redis (KEYS, PSUBSCRIBE) : * et ?
+// couvrent n'importe quel caractère, y compris "/", [abc], [a-z] et [^a]
+// désignent un ensemble, et \ échappe le caractère suivant.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			set, rest := pattern[1:], ""
+			negate := len(set) > 0 && set[0] == '^'
+			if negate {
+				set = set[1:]
+			}
+			matched := false
+			for len(set) > 0 && set[0] != ']' {
+				switch {
+				case set[0] == '\\' && len(set) > 1:
+					matched = matched || set[1] == s[0]
+					set = set[2:]
+				case len(set) > 2 && set[1] == '-' && set[2] != ']':
+					lo, hi := set[0], set[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (s[0] >= lo && s[0] <= hi)
+					set = set[3:]
+				default:
+					matched = matched || set[0] == s[0]
+					set = set[1:]
+				}
+			}
+			if len(set) > 0 {
+				rest = set[1:]
+			}
+			if matched == negate {
+				return false
+			}
+			pattern, s = rest, s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// checkGlob refuse un motif dont un ensemble [...] n'est pas fermé.
+func checkGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '[':
+			j := i + 1
+			for j < len(pattern) && pattern[j] != ']' {
+				if pattern[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(pattern) {
+				return fmt.Errorf("motif invalide : \"%s\"", pattern)
+			}
+			i = j
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// RowVersion est l'état d'une ligne après une opération, conservé dans
+// history/<table>/<id>.json quand l'historique de la table est activé.
+// Data est vide pour une suppression.
+type RowVersion struct {
+	Timestamp time.Time         `json:"timestamp"`
+	User      string            `json:"user,omitempty"`
+	Op        string            `json:"op"`
+	Data      map[string]string `json:"data,omitempty"`
+}
+
+// RowHistory retourne les versions d'une ligne, de la plus ancienne à la
+// plus récente.
+func RowHistory(databaseName, tableName, id string) ([]RowVersion, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	settings, err := GetTableSettings(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := loadHistory(databaseName, tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 && !settings.History {
+		return nil, fmt.Errorf("l'historique n'est pas activé pour la table \"%s\" (table set %s %s history on)", tableName, databaseName, tableName)
+	}
+	return versions, nil
+}
+
+// SelectAsOf reconstruit la table telle qu'elle était à l'instant asOf à
+// partir de l'historique, puis applique les conditions.
+func SelectAsOf(query Query, asOf time.Time) ([]map[string]string, error) {
+	schema, err := loadSchema(query.DBName)
+	if err != nil {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", query.DBName)
+	}
+	fields, ok := schema[query.Table]
+	if !ok {
+		return nil, fmt.Errorf("la table \"%s\" n'existe pas", query.Table)
+	}
+	settings, err := GetTableSettings(query.DBName, query.Table)
+	if err != nil {
+		return nil, err
+	}
+	if !settings.History {
+		return nil, fmt.Errorf("l'historique n'est pas activé pour la table \"%s\"", query.Table)
+	}
+	if asOf.Before(settings.HistorySince.Truncate(time.Second)) {
+		return nil, fmt.Errorf("l'historique de la table \"%s\" commence le %s", query.Table, settings.HistorySince.Format("02/01/2006 15:04:05"))
+	}
+
+	types := fieldTypes(fields)
+	for _, cond := range query.Conditions {
+		if _, ok := types[cond.Field]; !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", cond.Field, query.Table)
+		}
+	}
+
+	expiry, err := tableExpiry(query.DBName, query.Table)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := historyIDs(query.DBName, query.Table)
+	if err != nil {
+		return nil, err
+	}
+	results := []map[string]string{}
+	for _, id := range ids {
+		versions, err := loadHistory(query.DBName, query.Table, id)
+		if err != nil {
+			return nil, err
+		}
+		var state map[string]string
+		for _, version := range versions {
+			if version.Timestamp.After(asOf) {
+				break
+			}
+			state = version.Data
+		}
+		if state == nil || (isDeleted(state) && !query.IncludeDeleted) || expiry.expired(state, asOf) {
+			continue
+		}
+		if matchesConditions(state, query.Conditions, types, nil) {
+			results = append(results, state)
+		}
+	}
+	return results, nil
+}
+
+// ParseTimestamp lit une date au format RFC 3339, "AAAA-MM-JJ HH:MM:SS" ou
+// "AAAA-MM-JJ" (heure locale).
+func ParseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date invalide : \"%s\" (format attendu : AAAA-MM-JJ HH:MM:SS)", value)
+}
+
+// recordHistory ajoute la nouvelle version d'une ligne à son historique si
+// celui-ci est activé pour la table. entry vaut nil pour une suppression ;
+// op nomme l'opération quand elle ne se déduit pas de old et entry
+// (expiration).
+func recordHistory(databaseName, tableName, op string, old, entry map[string]string) error {
+	settings, err := GetTableSettings(databaseName, tableName)
+	if err != nil || !settings.History {
+		return err
+	}
+	version := RowVersion{Timestamp: time.Now(), User: currentUsername(), Data: publicRow(entry)}
+	id := ""
+	switch {
+	case entry == nil:
+		version.Op = "delete"
+		id = old["id"]
+	case old == nil:
+		version.Op = "insert"
+		id = entry["id"]
+	default:
+		version.Op = "update"
+		id = entry["id"]
+	}
+	if op != "" {
+		version.Op = op
+	}
+	return appendHistory(databaseName, tableName, id, version)
+}
+
+// snapshotHistory enregistre l'état courant de la table à l'activation de
+// l'historique, et marque comme supprimées les lignes disparues pendant une
+// éventuelle désactivation.
+func snapshotHistory(databaseName, tableName string, at time.Time) error {
+	ids, err := listRowIDs(databaseName, tableName)
+	if err != nil {
+		if _, statErr := os.Stat(fs.GetDataFilePath(databaseName, tableName)); !os.IsNotExist(statErr) {
+			return err
+		}
+		ids = nil
+	}
+	user := currentUsername()
+	current := map[string]bool{}
+	for _, id := range ids {
+		entry, err := readRow(databaseName, tableName, id)
+		if err != nil {
+			return err
+		}
+		current[id] = true
+		if err := appendHistory(databaseName, tableName, id, RowVersion{Timestamp: at, User: user, Op: "snapshot", Data: publicRow(entry)}); err != nil {
+			return err
+		}
+	}
+
+	known, err := historyIDs(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	for _, id := range known {
+		if current[id] {
+			continue
+		}
+		versions, err := loadHistory(databaseName, tableName, id)
+		if err != nil {
+			return err
+		}
+		if len(versions) > 0 && versions[len(versions)-1].Data != nil {
+			if err := appendHistory(databaseName, tableName, id, RowVersion{Timestamp: at, User: user, Op: "delete"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func appendHistory(databaseName, tableName, id string, version RowVersion) error {
+	versions, err := loadHistory(databaseName, tableName, id)
+	if err != nil {
+		return err
+	}
+	versions = append(versions, version)
+	content, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fs.GetHistoryFile(databaseName, tableName, id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+func loadHistory(databaseName, tableName, id string) ([]RowVersion, error) {
+	content, err := os.ReadFile(fs.GetHistoryFile(databaseName, tableName, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RowVersion{}, nil
+		}
+		return nil, err
+	}
+	var versions []RowVersion
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("historique de \"%s\" mal formé : %v", id, err)
+	}
+	return versions, nil
+}
+
+func historyIDs(databaseName, tableName string) ([]string, error) {
+	files, err := os.ReadDir(fs.GetHistoryFilePath(databaseName, tableName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func currentUsername() string {
+	session, err := LoadSession()
+	if err != nil {
+		return ""
+	}
+	return session.Username
+}
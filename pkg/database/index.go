@@ -0,0 +1,406 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+var allowedIndexKinds = map[string]bool{
+	"hash":     true,
+	"btree":    true,
+	"fulltext": true,
+}
+
+type IndexEntry struct {
+	Value string   `json:"value"`
+	IDs   []string `json:"ids"`
+}
+
+// Index est un index secondaire sur un champ d'une table. Un index "hash"
+// associe chaque valeur aux ids des lignes, un index "btree" garde les
+// valeurs triées selon le type du champ pour les recherches par intervalle
+// et un index "fulltext" associe chaque mot aux lignes qui le contiennent.
+type Index struct {
+	Table     string                    `json:"table"`
+	Field     string                    `json:"field"`
+	Kind      string                    `json:"kind"`
+	FieldType string                    `json:"fieldType"`
+	Stemming  bool                      `json:"stemming,omitempty"`
+	Hash      map[string][]string       `json:"hash,omitempty"`
+	Entries   []IndexEntry              `json:"entries,omitempty"`
+	Terms     map[string]map[string]int `json:"terms,omitempty"`
+	Docs      map[string]int            `json:"docs,omitempty"`
+}
+
+func CreateIndex(databaseName, tableName, fieldName, kind string) error {
+	return createIndex(databaseName, tableName, fieldName, kind, false)
+}
+
+// CreateFullTextIndex crée un index inversé sur un champ string. Avec
+// stemming, les mots sont réduits à leur racine (ex: "rapides" -> "rapid").
+func CreateFullTextIndex(databaseName, tableName, fieldName string, stemming bool) error {
+	return createIndex(databaseName, tableName, fieldName, "fulltext", stemming)
+}
+
+func createIndex(databaseName, tableName, fieldName, kind string, stemming bool) error {
+	if kind == "" {
+		kind = "hash"
+	}
+	if !allowedIndexKinds[kind] {
+		return fmt.Errorf("type d'index non autorisé : '%s' (hash, btree ou fulltext)", kind)
+	}
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return err
+	}
+	fields, ok := schema[tableName]
+	if !ok {
+		return fmt.Errorf("la table \"%s\" n'existe pas", tableName)
+	}
+	fieldType, ok := fieldTypes(fields)[fieldName]
+	if !ok {
+		return fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", fieldName, tableName)
+	}
+
+	if kind == "fulltext" && fieldType != "string" {
+		return fmt.Errorf("un index fulltext nécessite un champ string (\"%s\" est de type %s)", fieldName, fieldType)
+	}
+
+	path := fs.GetIndexFilePath(databaseName, tableName, fieldName)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("un index existe déjà sur %s.%s", tableName, fieldName)
+	}
+
+	idx := &Index{
+		Table:     tableName,
+		Field:     fieldName,
+		Kind:      kind,
+		FieldType: fieldType,
+		Stemming:  stemming,
+	}
+	if err := idx.build(databaseName); err != nil {
+		return err
+	}
+	return saveIndex(databaseName, idx)
+}
+
+func DropIndex(databaseName, tableName, fieldName string) error {
+	path := fs.GetIndexFilePath(databaseName, tableName, fieldName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("aucun index sur %s.%s", tableName, fieldName)
+	}
+	return os.Remove(path)
+}
+
+func ListIndexes(databaseName string) ([]*Index, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	return loadIndexes(databaseName, "")
+}
+
+// RebuildIndexes reconstruit les index d'une table à partir des fichiers de
+// données, ou ceux de toute la base si tableName est vide.
+func RebuildIndexes(databaseName, tableName string) error {
+	indexes, err := loadIndexes(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := idx.build(databaseName); err != nil {
+			return err
+		}
+		if err := saveIndex(databaseName, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *Index) Size() int {
+	switch idx.Kind {
+	case "hash":
+		return len(idx.Hash)
+	case "fulltext":
+		return len(idx.Terms)
+	}
+	return len(idx.Entries)
+}
+
+func (idx *Index) build(databaseName string) error {
+	idx.Hash = nil
+	idx.Entries = nil
+	idx.Terms = nil
+	idx.Docs = nil
+	if idx.Kind == "hash" {
+		idx.Hash = map[string][]string{}
+	}
+
+	tablePath := fs.GetDataFilePath(databaseName, idx.Table)
+	files, err := os.ReadDir(tablePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("impossible de lire le dossier table: %v", err)
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		row, err := readRow(databaseName, idx.Table, strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			return err
+		}
+		idx.add(row[idx.Field], row["id"])
+	}
+	return nil
+}
+
+func (idx *Index) add(value, id string) {
+	if idx.Kind == "fulltext" {
+		idx.addDocument(value, id)
+		return
+	}
+	if idx.Kind == "hash" {
+		if idx.Hash == nil {
+			idx.Hash = map[string][]string{}
+		}
+		for _, existing := range idx.Hash[value] {
+			if existing == id {
+				return
+			}
+		}
+		idx.Hash[value] = append(idx.Hash[value], id)
+		return
+	}
+
+	pos := idx.search(value)
+	if pos < len(idx.Entries) && idx.Entries[pos].Value == value {
+		for _, existing := range idx.Entries[pos].IDs {
+			if existing == id {
+				return
+			}
+		}
+		idx.Entries[pos].IDs = append(idx.Entries[pos].IDs, id)
+		return
+	}
+	idx.Entries = append(idx.Entries, IndexEntry{})
+	copy(idx.Entries[pos+1:], idx.Entries[pos:])
+	idx.Entries[pos] = IndexEntry{Value: value, IDs: []string{id}}
+}
+
+func (idx *Index) remove(value, id string) {
+	if idx.Kind == "fulltext" {
+		idx.removeDocument(value, id)
+		return
+	}
+	if idx.Kind == "hash" {
+		ids := removeID(idx.Hash[value], id)
+		if len(ids) == 0 {
+			delete(idx.Hash, value)
+		} else {
+			idx.Hash[value] = ids
+		}
+		return
+	}
+
+	pos := idx.search(value)
+	if pos >= len(idx.Entries) || idx.Entries[pos].Value != value {
+		return
+	}
+	idx.Entries[pos].IDs = removeID(idx.Entries[pos].IDs, id)
+	if len(idx.Entries[pos].IDs) == 0 {
+		idx.Entries = append(idx.Entries[:pos], idx.Entries[pos+1:]...)
+	}
+}
+
+func (idx *Index) lookup(value string) []string {
+	if idx.Kind == "hash" {
+		return idx.Hash[value]
+	}
+	pos := idx.search(value)
+	if pos < len(idx.Entries) && idx.Entries[pos].Value == value {
+		return idx.Entries[pos].IDs
+	}
+	return nil
+}
+
+// rangeIDs retourne les ids dont la valeur est comprise entre min et max
+// (bornes incluses, une borne vide n'est pas limitée). Réservé aux index btree.
+func (idx *Index) rangeIDs(min, max string) []string {
+	start := 0
+	if min != "" {
+		start = idx.search(min)
+	}
+	ids := []string{}
+	for _, entry := range idx.Entries[start:] {
+		if max != "" && compareIndexValues(entry.Value, max, idx.FieldType) > 0 {
+			break
+		}
+		ids = append(ids, entry.IDs...)
+	}
+	return ids
+}
+
+func (idx *Index) search(value string) int {
+	return sort.Search(len(idx.Entries), func(i int) bool {
+		return compareIndexValues(idx.Entries[i].Value, value, idx.FieldType) >= 0
+	})
+}
+
+func compareIndexValues(a, b, fieldType string) int {
+	if fieldType == "int" || fieldType == "float" {
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return strings.Compare(a, b)
+		}
+		if errA == nil && errB != nil {
+			return -1
+		}
+		if errA != nil && errB == nil {
+			return 1
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func removeID(ids []string, id string) []string {
+	filtered := []string{}
+	for _, existing := range ids {
+		if existing != id {
+			filtered = append(filtered, existing)
+		}
+	}
+	return filtered
+}
+
+func loadIndexes(databaseName, tableName string) ([]*Index, error) {
+	files, err := os.ReadDir(fs.GetIndexDirPath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	indexes := []*Index{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		if tableName != "" && !strings.HasPrefix(file.Name(), tableName+".") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(fs.GetIndexDirPath(databaseName), file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var idx Index
+		if err := json.Unmarshal(content, &idx); err != nil {
+			return nil, fmt.Errorf("index %s mal formé : %v", file.Name(), err)
+		}
+		if tableName != "" && idx.Table != tableName {
+			continue
+		}
+		indexes = append(indexes, &idx)
+	}
+	return indexes, nil
+}
+
+func loadIndex(databaseName, tableName, fieldName string) (*Index, error) {
+	content, err := os.ReadFile(fs.GetIndexFilePath(databaseName, tableName, fieldName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var idx Index
+	if err := json.Unmarshal(content, &idx); err != nil {
+		return nil, fmt.Errorf("index %s.%s mal formé : %v", tableName, fieldName, err)
+	}
+	return &idx, nil
+}
+
+func saveIndex(databaseName string, idx *Index) error {
+	if err := os.MkdirAll(fs.GetIndexDirPath(databaseName), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fs.GetIndexFilePath(databaseName, idx.Table, idx.Field), content, 0644)
+}
+
+// updateIndexes répercute le passage d'une ligne de old à entry sur tous les
+// index de la table. old vaut nil pour une insertion, entry nil pour une suppression.
+func updateIndexes(databaseName, tableName string, old, entry map[string]string) error {
+	indexes, err := loadIndexes(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if old != nil && entry != nil && old[idx.Field] == entry[idx.Field] {
+			continue
+		}
+		if old != nil {
+			idx.remove(old[idx.Field], old["id"])
+		}
+		if entry != nil {
+			idx.add(entry[idx.Field], entry["id"])
+		}
+		if err := saveIndex(databaseName, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropTableIndexes(databaseName, tableName string) error {
+	indexes, err := loadIndexes(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := DropIndex(databaseName, idx.Table, idx.Field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func renameTableIndexes(databaseName, oldTableName, newTableName string) error {
+	indexes, err := loadIndexes(databaseName, oldTableName)
+	if err != nil {
+		return err
+	}
+	for _, idx := range indexes {
+		if err := DropIndex(databaseName, idx.Table, idx.Field); err != nil {
+			return err
+		}
+		idx.Table = newTableName
+		if err := saveIndex(databaseName, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
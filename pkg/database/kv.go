@@ -0,0 +1,417 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// Le stockage clé-valeur d'une base est enregistré dans kv.json, à côté des
+// tables, et donc inclus dans les sauvegardes. Les clés expirées sont
+// ignorées à la lecture et supprimées à chaque écriture (expiration
+// paresseuse), ainsi que par StartKVExpiry dans les processus qui durent.
+
+// Valeurs particulières retournées par KVTTL, comme TTL en Redis.
+const (
+	KVTTLMissing  time.Duration = -2
+	KVTTLNoExpiry time.Duration = -1
+)
+
+// Types de valeurs, tels que retournés par KVType.
+const (
+	kvTypeString = "string"
+	kvTypeHash   = "hash"
+	kvTypeList   = "list"
+	kvTypeSet    = "set"
+	kvTypeZSet   = "zset"
+)
+
+// kvEntry contient la valeur d'une clé ; seul le champ correspondant à
+// Type est renseigné.
+type kvEntry struct {
+	Type      string            `json:"type"`
+	Value     string            `json:"value,omitempty"`
+	Hash      map[string]string `json:"hash,omitempty"`
+	List      []string          `json:"list,omitempty"`
+	Set       map[string]bool   `json:"set,omitempty"`
+	ZSet      map[string]zScore `json:"zset,omitempty"`
+	ExpiresAt int64             `json:"expires_at,omitempty"`
+}
+
+type kvStore struct {
+	Keys map[string]*kvEntry `json:"keys"`
+	// changed contient, pendant updateKV, l'entrée d'avant de chaque clé
+	// touchée (nil si elle n'existait pas).
+	changed map[string]*kvEntry
+}
+
+// KVSetOptions correspond aux options de SET : EX/PX (TTL), NX et XX.
+type KVSetOptions struct {
+	TTL time.Duration
+	NX  bool
+	XX  bool
+}
+
+func KVGet(databaseName, key string) (string, bool, error) {
+	value, found := "", false
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeString)
+		if err != nil || entry == nil {
+			return err
+		}
+		value, found = entry.Value, true
+		return nil
+	})
+	return value, found, err
+}
+
+// KVSet enregistre une valeur et retourne false si NX ou XX l'en ont empêché.
+// Comme en Redis, SET sans TTL retire une éventuelle expiration.
+func KVSet(databaseName, key, value string, options KVSetOptions) (bool, error) {
+	if options.NX && options.XX {
+		return false, fmt.Errorf("NX et XX ne peuvent pas être utilisés ensemble")
+	}
+	set := false
+	err := updateKV(databaseName, func(store *kvStore) error {
+		_, exists := store.Keys[key]
+		if (options.NX && exists) || (options.XX && !exists) {
+			return nil
+		}
+		entry := &kvEntry{Type: kvTypeString, Value: value}
+		if options.TTL > 0 {
+			entry.ExpiresAt = time.Now().Add(options.TTL).UnixMilli()
+		}
+		store.put(key, entry)
+		set = true
+		return nil
+	})
+	return set, err
+}
+
+func KVDel(databaseName string, keys ...string) (int, error) {
+	deleted := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		for _, key := range keys {
+			if _, ok := store.Keys[key]; ok {
+				store.remove(key)
+				deleted++
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// KVExists compte les clés présentes ; une clé répétée est comptée
+// plusieurs fois.
+func KVExists(databaseName string, keys ...string) (int, error) {
+	count := 0
+	err := viewKV(databaseName, func(store *kvStore) error {
+		for _, key := range keys {
+			if store.lookup(key) != nil {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// KVIncrBy ajoute delta à l'entier enregistré sous key (0 si la clé
+// n'existe pas) et retourne la nouvelle valeur. L'expiration est conservée.
+func KVIncrBy(databaseName, key string, delta int64) (int64, error) {
+	var result int64
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeString)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			entry = &kvEntry{Type: kvTypeString, Value: "0"}
+		}
+		current, err := strconv.ParseInt(entry.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("la valeur de \"%s\" n'est pas un entier", key)
+		}
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return fmt.Errorf("dépassement de capacité en incrémentant \"%s\"", key)
+		}
+		result = current + delta
+		store.touch(key)
+		entry.Value = strconv.FormatInt(result, 10)
+		store.Keys[key] = entry
+		return nil
+	})
+	return result, err
+}
+
+// KVMGet retourne les valeurs des clés dans l'ordre ; nil pour une clé
+// absente ou qui n'est pas une chaîne.
+func KVMGet(databaseName string, keys ...string) ([]*string, error) {
+	values := make([]*string, len(keys))
+	err := viewKV(databaseName, func(store *kvStore) error {
+		for i, key := range keys {
+			if entry := store.lookup(key); entry != nil && entry.Type == kvTypeString {
+				value := entry.Value
+				values[i] = &value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func KVMSet(databaseName string, pairs map[string]string) error {
+	return updateKV(databaseName, func(store *kvStore) error {
+		for key, value := range pairs {
+			store.put(key, &kvEntry{Type: kvTypeString, Value: value})
+		}
+		return nil
+	})
+}
+
+// KVExpire fixe la durée de vie d'une clé et retourne false si elle
+// n'existe pas. Une durée négative ou nulle supprime la clé.
+func KVExpire(databaseName, key string, ttl time.Duration) (bool, error) {
+	found := false
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, ok := store.Keys[key]
+		if !ok {
+			return nil
+		}
+		found = true
+		if ttl <= 0 {
+			store.remove(key)
+			return nil
+		}
+		store.touch(key)
+		entry.ExpiresAt = time.Now().Add(ttl).UnixMilli()
+		return nil
+	})
+	return found, err
+}
+
+// KVTTL retourne la durée de vie restante d'une clé, KVTTLNoExpiry si elle
+// n'expire pas ou KVTTLMissing si elle n'existe pas.
+func KVTTL(databaseName, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry := store.lookup(key)
+		switch {
+		case entry == nil:
+			ttl = KVTTLMissing
+		case entry.ExpiresAt == 0:
+			ttl = KVTTLNoExpiry
+		default:
+			ttl = time.Until(time.UnixMilli(entry.ExpiresAt))
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// KVPersist retire l'expiration d'une clé et retourne false si elle
+// n'existe pas ou n'expirait pas.
+func KVPersist(databaseName, key string) (bool, error) {
+	changed := false
+	err := updateKV(databaseName, func(store *kvStore) error {
+		if entry, ok := store.Keys[key]; ok && entry.ExpiresAt != 0 {
+			store.touch(key)
+			entry.ExpiresAt = 0
+			changed = true
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// KVKeys retourne les clés correspondant au motif (syntaxe de Redis, voir
+// globMatch), triées.
+func KVKeys(databaseName, pattern string) ([]string, error) {
+	if err := checkGlob(pattern); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		for key := range store.Keys {
+			if globMatch(pattern, key) && store.lookup(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// PurgeExpiredKeys supprime les clés expirées et retourne leur nombre.
+func PurgeExpiredKeys(databaseName string) (int, error) {
+	purged := 0
+	err := viewKV(databaseName, func(store *kvStore) error {
+		purged = store.expiredCount()
+		return nil
+	})
+	if err != nil || purged == 0 {
+		return 0, err
+	}
+	return purged, updateKV(databaseName, func(store *kvStore) error { return nil })
+}
+
+// StartKVExpiry supprime périodiquement les clés expirées de la base
+// jusqu'à l'annulation du contexte.
+func StartKVExpiry(ctx context.Context, databaseName string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				PurgeExpiredKeys(databaseName)
+			}
+		}
+	}()
+}
+
+// lookup retourne l'entrée de la clé, ou nil si elle n'existe pas ou a
+// expiré.
+func (s *kvStore) lookup(key string) *kvEntry {
+	entry, ok := s.Keys[key]
+	if !ok || entry.expired(time.Now()) {
+		return nil
+	}
+	return entry
+}
+
+// get retourne l'entrée de la clé si elle est du type attendu.
+func (s *kvStore) get(key, kind string) (*kvEntry, error) {
+	entry := s.lookup(key)
+	if entry != nil && entry.Type != kind {
+		return nil, fmt.Errorf("WRONGTYPE la clé \"%s\" contient une valeur de type %s", key, entry.Type)
+	}
+	return entry, nil
+}
+
+func (s *kvStore) expiredCount() int {
+	now := time.Now()
+	count := 0
+	for _, entry := range s.Keys {
+		if entry.expired(now) {
+			count++
+		}
+	}
+	return count
+}
+
+func (e *kvEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && now.UnixMilli() >= e.ExpiresAt
+}
+
+// viewKV applique fn au stockage à jour, sans prendre le verrou d'écriture.
+// fn ne doit ni modifier le stockage ni en garder de référence.
+func viewKV(databaseName string, fn func(store *kvStore) error) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	state := kvStateOf(databaseName)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err := state.refresh(databaseName); err != nil {
+		return err
+	}
+	return fn(state.store)
+}
+
+// updateKV applique fn au stockage sous verrou, puis enregistre les clés
+// qu'il a touchées, ainsi que les clés expirées supprimées au passage, selon
+// le mode de persistance de la base. fn signale chaque clé qu'il modifie
+// (touch, put, remove, getOrCreate) ; s'il retourne une erreur, ses
+// modifications sont annulées et rien n'est écrit.
+func updateKV(databaseName string, fn func(store *kvStore) error) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockFile(fs.GetKVFilePath(databaseName) + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := kvStateOf(databaseName)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err := state.refresh(databaseName); err != nil {
+		return err
+	}
+	store := state.store
+	store.changed = map[string]*kvEntry{}
+	defer func() { store.changed = nil }()
+	now := time.Now()
+	for key, entry := range store.Keys {
+		if entry.expired(now) {
+			store.remove(key)
+		}
+	}
+	if err := fn(store); err != nil {
+		store.rollback()
+		return err
+	}
+	return state.persist(databaseName)
+}
+
+// touch signale que la clé va être modifiée, en gardant son entrée d'avant
+// pour pouvoir l'annuler.
+func (s *kvStore) touch(key string) {
+	if _, ok := s.changed[key]; ok {
+		return
+	}
+	var before *kvEntry
+	if entry, ok := s.Keys[key]; ok {
+		before = entry.clone()
+	}
+	s.changed[key] = before
+}
+
+func (s *kvStore) put(key string, entry *kvEntry) {
+	s.touch(key)
+	s.Keys[key] = entry
+}
+
+func (s *kvStore) remove(key string) {
+	s.touch(key)
+	delete(s.Keys, key)
+}
+
+// rollback rétablit les clés touchées depuis le début de la modification.
+func (s *kvStore) rollback() {
+	for key, before := range s.changed {
+		if before != nil {
+			s.Keys[key] = before
+		} else {
+			delete(s.Keys, key)
+		}
+	}
+	s.changed = map[string]*kvEntry{}
+}
+
+func (e *kvEntry) clone() *kvEntry {
+	c := *e
+	c.Hash = maps.Clone(e.Hash)
+	c.List = slices.Clone(e.List)
+	c.Set = maps.Clone(e.Set)
+	c.ZSet = maps.Clone(e.ZSet)
+	return &c
+}
@@ -0,0 +1,500 @@
+package database
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/resp"
+)
+
+// kvCommand décrit une commande clé-valeur : arity est le nombre
+// d'arguments, nom compris, ou son opposé pour un minimum (comme dans
+// COMMAND de Redis).
+type kvCommand struct {
+	arity int
+	run   func(databaseName string, args []string) any
+}
+
+var kvCommands map[string]kvCommand
+
+func init() {
+	kvCommands = map[string]kvCommand{
+		"get":           {2, kvCmdGet},
+		"set":           {-3, kvCmdSet},
+		"del":           {-2, kvCmdDel},
+		"exists":        {-2, kvCmdExists},
+		"incr":          {2, kvCmdIncr},
+		"decr":          {2, kvCmdIncr},
+		"incrby":        {3, kvCmdIncr},
+		"decrby":        {3, kvCmdIncr},
+		"mget":          {-2, kvCmdMGet},
+		"mset":          {-3, kvCmdMSet},
+		"expire":        {3, kvCmdExpire},
+		"pexpire":       {3, kvCmdExpire},
+		"ttl":           {2, kvCmdTTL},
+		"pttl":          {2, kvCmdTTL},
+		"persist":       {2, kvCmdPersist},
+		"keys":          {2, kvCmdKeys},
+		"dbsize":        {1, kvCmdDBSize},
+		"type":          {2, kvCmdType},
+		"hset":          {-4, kvCmdHSet},
+		"hget":          {3, kvCmdHGet},
+		"hgetall":       {2, kvCmdHGetAll},
+		"lpush":         {-3, kvCmdPush},
+		"rpush":         {-3, kvCmdPush},
+		"lpop":          {2, kvCmdPop},
+		"rpop":          {2, kvCmdPop},
+		"lrange":        {4, kvCmdLRange},
+		"sadd":          {-3, kvCmdSAdd},
+		"srem":          {-3, kvCmdSRem},
+		"smembers":      {2, kvCmdSInter},
+		"sinter":        {-2, kvCmdSInter},
+		"zadd":          {-4, kvCmdZAdd},
+		"zrange":        {-4, kvCmdZRange},
+		"zrangebyscore": {-4, kvCmdZRangeByScore},
+		"save":          {1, kvCmdSave},
+		"bgsave":        {-1, kvCmdSave},
+		"bgrewriteaof":  {1, kvCmdSave},
+		"lastsave":      {1, kvCmdLastSave},
+	}
+}
+
+// IsKVCommand indique si name est une commande du stockage clé-valeur.
+func IsKVCommand(name string) bool {
+	_, ok := kvCommands[strings.ToLower(name)]
+	return ok
+}
+
+// ExecKVCommand exécute une commande Redis (nom puis arguments) sur le
+// stockage clé-valeur de la base et retourne la réponse à encoder avec le
+// paquet resp.
+func ExecKVCommand(databaseName string, args []string) any {
+	if len(args) == 0 {
+		return resp.Errorf("commande vide")
+	}
+	name := strings.ToLower(args[0])
+	cmd, ok := kvCommands[name]
+	if !ok {
+		return resp.Errorf("commande inconnue '%s'", args[0])
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		return resp.Errorf("nombre d'arguments incorrect pour la commande '%s'", name)
+	}
+	return cmd.run(databaseName, args)
+}
+
+// kvError convertit une erreur du stockage en réponse, en conservant le
+// code WRONGTYPE.
+func kvError(err error) resp.Error {
+	if strings.HasPrefix(err.Error(), "WRONGTYPE ") {
+		return resp.Error(err.Error())
+	}
+	return resp.Errorf("%s", err.Error())
+}
+
+func kvCmdGet(db string, args []string) any {
+	value, ok, err := KVGet(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+func kvCmdSet(db string, args []string) any {
+	options := KVSetOptions{}
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			options.NX = true
+		case "xx":
+			options.XX = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				return resp.Errorf("erreur de syntaxe")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return resp.Errorf("durée invalide dans '%s'", args[0])
+			}
+			options.TTL = time.Duration(n) * time.Second
+			if strings.ToLower(args[i]) == "px" {
+				options.TTL = time.Duration(n) * time.Millisecond
+			}
+			i++
+		default:
+			return resp.Errorf("erreur de syntaxe")
+		}
+	}
+	set, err := KVSet(db, args[1], args[2], options)
+	if err != nil {
+		return kvError(err)
+	}
+	if !set {
+		return nil
+	}
+	return resp.SimpleString("OK")
+}
+
+func kvCmdDel(db string, args []string) any {
+	n, err := KVDel(db, args[1:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	return n
+}
+
+func kvCmdExists(db string, args []string) any {
+	n, err := KVExists(db, args[1:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	return n
+}
+
+func kvCmdIncr(db string, args []string) any {
+	name := strings.ToLower(args[0])
+	delta := int64(1)
+	if strings.HasSuffix(name, "by") {
+		n, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return resp.Errorf("la valeur n'est pas un entier ou est hors limites")
+		}
+		delta = n
+	}
+	if strings.HasPrefix(name, "decr") {
+		if delta == math.MinInt64 {
+			return resp.Errorf("décrément hors limites")
+		}
+		delta = -delta
+	}
+	value, err := KVIncrBy(db, args[1], delta)
+	if err != nil {
+		return kvError(err)
+	}
+	return value
+}
+
+func kvCmdMGet(db string, args []string) any {
+	values, err := KVMGet(db, args[1:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	reply := make([]any, len(values))
+	for i, value := range values {
+		if value != nil {
+			reply[i] = *value
+		}
+	}
+	return reply
+}
+
+func kvCmdMSet(db string, args []string) any {
+	if len(args)%2 != 1 {
+		return resp.Errorf("nombre d'arguments incorrect pour la commande 'mset'")
+	}
+	pairs := map[string]string{}
+	for i := 1; i < len(args); i += 2 {
+		pairs[args[i]] = args[i+1]
+	}
+	if err := KVMSet(db, pairs); err != nil {
+		return kvError(err)
+	}
+	return resp.SimpleString("OK")
+}
+
+func kvCmdExpire(db string, args []string) any {
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return resp.Errorf("la valeur n'est pas un entier ou est hors limites")
+	}
+	ttl := time.Duration(n) * time.Second
+	if strings.ToLower(args[0]) == "pexpire" {
+		ttl = time.Duration(n) * time.Millisecond
+	}
+	ok, err := KVExpire(db, args[1], ttl)
+	if err != nil {
+		return kvError(err)
+	}
+	return boolReply(ok)
+}
+
+func kvCmdTTL(db string, args []string) any {
+	ttl, err := KVTTL(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	if ttl < 0 {
+		return int64(ttl)
+	}
+	if strings.ToLower(args[0]) == "pttl" {
+		return ttl.Milliseconds()
+	}
+	return int64((ttl + time.Second/2) / time.Second)
+}
+
+func kvCmdPersist(db string, args []string) any {
+	ok, err := KVPersist(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	return boolReply(ok)
+}
+
+func kvCmdKeys(db string, args []string) any {
+	keys, err := KVKeys(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	return keys
+}
+
+func kvCmdDBSize(db string, args []string) any {
+	keys, err := KVKeys(db, "*")
+	if err != nil {
+		return kvError(err)
+	}
+	return len(keys)
+}
+
+func kvCmdType(db string, args []string) any {
+	kind, err := KVType(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	return resp.SimpleString(kind)
+}
+
+func kvCmdHSet(db string, args []string) any {
+	if len(args)%2 != 0 {
+		return resp.Errorf("nombre d'arguments incorrect pour la commande 'hset'")
+	}
+	fields := map[string]string{}
+	for i := 2; i < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	added, err := KVHSet(db, args[1], fields)
+	if err != nil {
+		return kvError(err)
+	}
+	return added
+}
+
+func kvCmdHGet(db string, args []string) any {
+	value, ok, err := KVHGet(db, args[1], args[2])
+	if err != nil {
+		return kvError(err)
+	}
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+func kvCmdHGetAll(db string, args []string) any {
+	fields, err := KVHGetAll(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	reply := resp.Map{}
+	for field, value := range fields {
+		reply = append(reply, field, value)
+	}
+	return reply
+}
+
+func kvCmdPush(db string, args []string) any {
+	push := KVRPush
+	if strings.ToLower(args[0]) == "lpush" {
+		push = KVLPush
+	}
+	length, err := push(db, args[1], args[2:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	return length
+}
+
+func kvCmdPop(db string, args []string) any {
+	pop := KVRPop
+	if strings.ToLower(args[0]) == "lpop" {
+		pop = KVLPop
+	}
+	value, ok, err := pop(db, args[1])
+	if err != nil {
+		return kvError(err)
+	}
+	if !ok {
+		return nil
+	}
+	return value
+}
+
+func kvCmdLRange(db string, args []string) any {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return resp.Errorf("la valeur n'est pas un entier ou est hors limites")
+	}
+	values, err := KVLRange(db, args[1], start, stop)
+	if err != nil {
+		return kvError(err)
+	}
+	return values
+}
+
+func kvCmdSAdd(db string, args []string) any {
+	n, err := KVSAdd(db, args[1], args[2:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	return n
+}
+
+func kvCmdSRem(db string, args []string) any {
+	n, err := KVSRem(db, args[1], args[2:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	return n
+}
+
+func kvCmdSInter(db string, args []string) any {
+	members, err := KVSInter(db, args[1:]...)
+	if err != nil {
+		return kvError(err)
+	}
+	reply := make(resp.Set, len(members))
+	for i, member := range members {
+		reply[i] = member
+	}
+	return reply
+}
+
+func kvCmdZAdd(db string, args []string) any {
+	if len(args)%2 != 0 {
+		return resp.Errorf("erreur de syntaxe")
+	}
+	members := []ZMember{}
+	for i := 2; i < len(args); i += 2 {
+		score, err := strconv.ParseFloat(args[i], 64)
+		if err != nil || math.IsNaN(score) {
+			return resp.Errorf("la valeur n'est pas un nombre valide")
+		}
+		members = append(members, ZMember{Member: args[i+1], Score: score})
+	}
+	added, err := KVZAdd(db, args[1], members...)
+	if err != nil {
+		return kvError(err)
+	}
+	return added
+}
+
+func kvCmdZRange(db string, args []string) any {
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return resp.Errorf("la valeur n'est pas un entier ou est hors limites")
+	}
+	withScores, ok := parseWithScores(args[4:])
+	if !ok {
+		return resp.Errorf("erreur de syntaxe")
+	}
+	members, err := KVZRange(db, args[1], start, stop)
+	if err != nil {
+		return kvError(err)
+	}
+	return zMembersReply(members, withScores)
+}
+
+func kvCmdZRangeByScore(db string, args []string) any {
+	min, minExcl, err1 := parseScoreBound(args[2])
+	max, maxExcl, err2 := parseScoreBound(args[3])
+	if err1 != nil || err2 != nil {
+		return resp.Errorf("min ou max n'est pas un nombre valide")
+	}
+	withScores, ok := parseWithScores(args[4:])
+	if !ok {
+		return resp.Errorf("erreur de syntaxe")
+	}
+	members, err := KVZRangeByScore(db, args[1], min, max)
+	if err != nil {
+		return kvError(err)
+	}
+	filtered := []ZMember{}
+	for _, m := range members {
+		if (minExcl && m.Score == min) || (maxExcl && m.Score == max) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return zMembersReply(filtered, withScores)
+}
+
+// parseScoreBound lit une borne de ZRANGEBYSCORE : un nombre, -inf, +inf,
+// ou "(" suivi d'un nombre pour une borne exclue.
+func parseScoreBound(value string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(value, "(")
+	score, err := strconv.ParseFloat(strings.TrimPrefix(value, "("), 64)
+	if err == nil && math.IsNaN(score) {
+		err = strconv.ErrSyntax
+	}
+	return score, exclusive, err
+}
+
+func parseWithScores(args []string) (bool, bool) {
+	switch {
+	case len(args) == 0:
+		return false, true
+	case len(args) == 1 && strings.ToLower(args[0]) == "withscores":
+		return true, true
+	}
+	return false, false
+}
+
+func zMembersReply(members []ZMember, withScores bool) any {
+	reply := []any{}
+	for _, m := range members {
+		reply = append(reply, m.Member)
+		if withScores {
+			reply = append(reply, m.Score)
+		}
+	}
+	return reply
+}
+
+// kvCmdSave traite SAVE, BGSAVE et BGREWRITEAOF, qui recopient tous l'état
+// dans kv.json et vident le journal ; l'enregistrement est synchrone.
+func kvCmdSave(db string, args []string) any {
+	if err := KVSave(db); err != nil {
+		return kvError(err)
+	}
+	switch strings.ToLower(args[0]) {
+	case "bgsave":
+		return resp.SimpleString("Background saving started")
+	case "bgrewriteaof":
+		return resp.SimpleString("Background append only file rewriting started")
+	}
+	return resp.SimpleString("OK")
+}
+
+func kvCmdLastSave(db string, args []string) any {
+	lastSave, err := KVLastSave(db)
+	if err != nil {
+		return kvError(err)
+	}
+	if lastSave.IsZero() {
+		return 0
+	}
+	return lastSave.Unix()
+}
+
+func boolReply(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
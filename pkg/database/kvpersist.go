@@ -0,0 +1,535 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// Persistance du stockage clé-valeur :
+//   - snapshot (par défaut) : les clés modifiées sont gardées en mémoire et
+//     kv.json est réécrit au plus kvSnapshotDelay après, ou par KVSave et
+//     KVFlush ;
+//   - aof : chaque modification ajoute à kv.aof les clés changées (PUT ou
+//     DEL, au format RESP) ; kv.json sert de base et le journal est rejoué
+//     par-dessus. KVSave (ou la réécriture automatique quand le journal
+//     dépasse auto_rewrite) recopie l'état dans kv.json et vide le journal.
+// Chaque processus garde le stockage en mémoire et ne relit que ce que les
+// autres ont écrit depuis : la fin du journal, ou tout si kv.json a changé.
+// Un dernier enregistrement incomplet (écriture interrompue) est ignoré à la
+// lecture et tronqué à l'écriture suivante ; un journal abîmé ailleurs est
+// une erreur.
+const (
+	kvPersistenceSnapshot = "snapshot"
+	kvPersistenceAOF      = "aof"
+)
+
+const kvSnapshotDelay = time.Second
+
+var errAOFTorn = errors.New("enregistrement incomplet")
+
+// kvState est le stockage d'une base tel que le processus l'a chargé.
+// snapshot et aof sont les fichiers lus, aofSize la partie du journal déjà
+// rejouée ; dirty contient les clés modifiées qui ne sont encore ni dans
+// kv.json ni dans le journal.
+type kvState struct {
+	mu        sync.Mutex
+	store     *kvStore
+	snapshot  os.FileInfo
+	aof       os.FileInfo
+	aofSize   int64
+	dirty     map[string]bool
+	scheduled bool
+}
+
+var kvStates = struct {
+	sync.Mutex
+	byDB map[string]*kvState
+}{byDB: map[string]*kvState{}}
+
+// Synchronisations différées du mode everysec, par fichier.
+var aofSyncs = struct {
+	sync.Mutex
+	pending map[string]bool
+}{pending: map[string]bool{}}
+
+// KVSave enregistre l'état courant du stockage dans kv.json et vide le
+// journal AOF.
+func KVSave(databaseName string) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockFile(fs.GetKVFilePath(databaseName) + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state := kvStateOf(databaseName)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if err := state.refresh(databaseName); err != nil {
+		return err
+	}
+	config, err := GetKVConfig(databaseName)
+	if err != nil {
+		return err
+	}
+	return state.compact(databaseName, config)
+}
+
+// KVFlush enregistre dans kv.json les modifications du mode snapshot qui ne
+// le sont pas encore. Il est appelé kvSnapshotDelay après une modification ;
+// un processus qui se termine l'appelle pour ne rien perdre.
+func KVFlush(databaseName string) error {
+	kvStates.Lock()
+	state, ok := kvStates.byDB[databaseName]
+	kvStates.Unlock()
+	if !ok {
+		return nil
+	}
+	state.mu.Lock()
+	pending := len(state.dirty) > 0
+	state.mu.Unlock()
+	if !pending {
+		return nil
+	}
+	return KVSave(databaseName)
+}
+
+// KVLastSave retourne la date du dernier enregistrement de kv.json.
+func KVLastSave(databaseName string) (time.Time, error) {
+	info, err := os.Stat(fs.GetKVFilePath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func kvStateOf(databaseName string) *kvState {
+	kvStates.Lock()
+	defer kvStates.Unlock()
+	state, ok := kvStates.byDB[databaseName]
+	if !ok {
+		state = &kvState{dirty: map[string]bool{}}
+		kvStates.byDB[databaseName] = state
+	}
+	return state
+}
+
+// refresh met le stockage à jour avec ce que les autres processus ont écrit
+// depuis le dernier passage : seule la fin du journal est rejouée s'il a
+// grandi, tout est relu si kv.json a été remplacé ou le journal réécrit.
+func (s *kvState) refresh(databaseName string) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	snapshot, err := statKVFile(fs.GetKVFilePath(databaseName))
+	if err != nil {
+		return err
+	}
+	aof, err := statKVFile(fs.GetKVAOFPath(databaseName))
+	if err != nil {
+		return err
+	}
+	if s.store == nil || !sameKVFile(s.snapshot, snapshot) {
+		return s.reload(databaseName)
+	}
+	if s.aof != nil && (aof == nil || !os.SameFile(s.aof, aof) || aof.Size() < s.aofSize) {
+		return s.reload(databaseName)
+	}
+	if aof == nil || aof.Size() == s.aofSize {
+		return nil
+	}
+
+	f, err := os.Open(fs.GetKVAOFPath(databaseName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	tail := make([]byte, info.Size()-s.aofSize)
+	n, err := f.ReadAt(tail, s.aofSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	var valid int64
+	s.keepDirty(func() {
+		valid, err = replayAOF(s.store, tail[:n])
+	})
+	if err != nil {
+		return err
+	}
+	s.aof, s.aofSize = info, s.aofSize+valid
+	return nil
+}
+
+// reload relit kv.json puis rejoue tout le journal.
+func (s *kvState) reload(databaseName string) error {
+	store := &kvStore{Keys: map[string]*kvEntry{}}
+	content, snapshot, err := readKVFile(fs.GetKVFilePath(databaseName))
+	if err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, store); err != nil {
+			return fmt.Errorf("kv.json mal formé : %v", err)
+		}
+	}
+	if store.Keys == nil {
+		store.Keys = map[string]*kvEntry{}
+	}
+	log, aof, err := readKVFile(fs.GetKVAOFPath(databaseName))
+	if err != nil {
+		return err
+	}
+	valid, err := replayAOF(store, log)
+	if err != nil {
+		return err
+	}
+
+	previous := s.store
+	s.store, s.snapshot, s.aof, s.aofSize = store, snapshot, aof, valid
+	if previous != nil {
+		for key := range s.dirty {
+			if entry, ok := previous.Keys[key]; ok {
+				store.Keys[key] = entry
+			} else {
+				delete(store.Keys, key)
+			}
+		}
+	}
+	return nil
+}
+
+// keepDirty exécute fn en conservant les clés modifiées ici et pas encore
+// enregistrées.
+func (s *kvState) keepDirty(fn func()) {
+	kept := make(map[string]*kvEntry, len(s.dirty))
+	for key := range s.dirty {
+		kept[key] = s.store.Keys[key]
+	}
+	fn()
+	for key, entry := range kept {
+		if entry != nil {
+			s.store.Keys[key] = entry
+		} else {
+			delete(s.store.Keys, key)
+		}
+	}
+}
+
+// persist enregistre les clés touchées par la dernière modification. En mode
+// aof elles sont ajoutées au journal, et la modification est annulée si
+// l'écriture échoue ; en mode snapshot elles sont gardées pour le prochain
+// enregistrement de kv.json.
+func (s *kvState) persist(databaseName string) error {
+	changed := s.store.changed
+	if len(changed) == 0 {
+		return nil
+	}
+	config, err := GetKVConfig(databaseName)
+	if err != nil {
+		s.store.rollback()
+		return err
+	}
+	if config.Persistence != kvPersistenceAOF {
+		for key := range changed {
+			s.dirty[key] = true
+		}
+		s.scheduleSnapshot(databaseName)
+		return nil
+	}
+
+	keys := make([]string, 0, len(changed)+len(s.dirty))
+	for key := range changed {
+		keys = append(keys, key)
+	}
+	for key := range s.dirty {
+		if _, ok := changed[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var records bytes.Buffer
+	for _, key := range keys {
+		entry, ok := s.store.Keys[key]
+		if !ok {
+			writeAOFRecord(&records, "DEL", key)
+			continue
+		}
+		content, err := json.Marshal(entry)
+		if err != nil {
+			s.store.rollback()
+			return err
+		}
+		writeAOFRecord(&records, "PUT", key, string(content))
+	}
+
+	size, err := appendAOF(databaseName, records.Bytes(), s.aofSize, config)
+	if err != nil {
+		s.store.rollback()
+		return err
+	}
+	s.dirty = map[string]bool{}
+	s.aofSize = size
+	if s.aof, err = statKVFile(fs.GetKVAOFPath(databaseName)); err != nil {
+		return err
+	}
+	if config.AutoRewrite > 0 && size > config.AutoRewrite {
+		if s.snapshot == nil || size > 2*s.snapshot.Size() {
+			return s.compact(databaseName, config)
+		}
+	}
+	return nil
+}
+
+// compact écrit l'état complet dans kv.json et supprime le journal.
+func (s *kvState) compact(databaseName string, config KVConfig) error {
+	if err := compactKV(databaseName, s.store, config); err != nil {
+		return err
+	}
+	s.dirty = map[string]bool{}
+	s.aof, s.aofSize = nil, 0
+	var err error
+	s.snapshot, err = statKVFile(fs.GetKVFilePath(databaseName))
+	return err
+}
+
+// scheduleSnapshot programme l'enregistrement de kv.json kvSnapshotDelay
+// plus tard, s'il ne l'est pas déjà. Il est appelé sous s.mu.
+func (s *kvState) scheduleSnapshot(databaseName string) {
+	if s.scheduled {
+		return
+	}
+	s.scheduled = true
+	time.AfterFunc(kvSnapshotDelay, func() {
+		s.mu.Lock()
+		s.scheduled = false
+		s.mu.Unlock()
+		if err := KVFlush(databaseName); err != nil && fs.DoesDirExist(databaseName) {
+			s.mu.Lock()
+			s.scheduleSnapshot(databaseName)
+			s.mu.Unlock()
+		}
+	})
+}
+
+// statKVFile retourne les informations du fichier, nil s'il n'existe pas.
+func statKVFile(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return info, err
+}
+
+// readKVFile lit le fichier et retourne les informations du fichier lu, nil
+// s'il n'existe pas.
+func readKVFile(path string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(f)
+	return content, info, err
+}
+
+// sameKVFile indique si deux états d'un fichier sont identiques : kv.json
+// est remplacé par renommage à chaque enregistrement.
+func sameKVFile(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// replayAOF applique les enregistrements du journal et retourne la taille de
+// la partie valide.
+func replayAOF(store *kvStore, log []byte) (int64, error) {
+	offset := 0
+	for offset < len(log) {
+		record, n, err := parseAOFRecord(log[offset:])
+		if errors.Is(err, errAOFTorn) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("kv.aof corrompu à l'octet %d : %v", offset, err)
+		}
+		switch {
+		case len(record) == 3 && record[0] == "PUT":
+			var entry kvEntry
+			if err := json.Unmarshal([]byte(record[2]), &entry); err != nil {
+				return 0, fmt.Errorf("kv.aof corrompu à l'octet %d : %v", offset, err)
+			}
+			store.Keys[record[1]] = &entry
+		case len(record) == 2 && record[0] == "DEL":
+			delete(store.Keys, record[1])
+		default:
+			return 0, fmt.Errorf("kv.aof corrompu à l'octet %d : enregistrement inconnu", offset)
+		}
+		offset += n
+	}
+	return int64(offset), nil
+}
+
+// parseAOFRecord lit un tableau RESP de chaînes au début de data et retourne
+// le nombre d'octets lus. errAOFTorn signale que data s'arrête au milieu de
+// l'enregistrement.
+func parseAOFRecord(data []byte) ([]string, int, error) {
+	line, pos, err := aofLine(data, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, 0, fmt.Errorf("tableau attendu")
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count < 1 || count > 3 {
+		return nil, 0, fmt.Errorf("taille de tableau invalide")
+	}
+	record := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, pos, err = aofLine(data, pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(line) < 2 || line[0] != '$' {
+			return nil, 0, fmt.Errorf("chaîne attendue")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			return nil, 0, fmt.Errorf("taille de chaîne invalide")
+		}
+		if pos+size+2 > len(data) {
+			return nil, 0, errAOFTorn
+		}
+		if data[pos+size] != '\r' || data[pos+size+1] != '\n' {
+			return nil, 0, fmt.Errorf("fin de chaîne attendue")
+		}
+		record = append(record, string(data[pos:pos+size]))
+		pos += size + 2
+	}
+	return record, pos, nil
+}
+
+func aofLine(data []byte, pos int) ([]byte, int, error) {
+	end := bytes.Index(data[pos:], []byte("\r\n"))
+	if end < 0 {
+		if len(data)-pos > 32 {
+			return nil, 0, fmt.Errorf("ligne trop longue")
+		}
+		return nil, 0, errAOFTorn
+	}
+	return data[pos : pos+end], pos + end + 2, nil
+}
+
+// appendAOF ajoute des enregistrements au journal, après avoir tronqué un
+// éventuel enregistrement incomplet, et retourne la nouvelle taille.
+func appendAOF(databaseName string, records []byte, validSize int64, config KVConfig) (int64, error) {
+	path := fs.GetKVAOFPath(databaseName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() != validSize {
+		if err := f.Truncate(validSize); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := f.WriteAt(records, validSize); err != nil {
+		return 0, err
+	}
+	switch config.Fsync {
+	case "always":
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	case "everysec":
+		scheduleAOFSync(path)
+	}
+	return validSize + int64(len(records)), nil
+}
+
+// scheduleAOFSync synchronise le journal sur disque au plus une seconde
+// après l'écriture, tant que le processus tourne.
+func scheduleAOFSync(path string) {
+	aofSyncs.Lock()
+	defer aofSyncs.Unlock()
+	if aofSyncs.pending[path] {
+		return
+	}
+	aofSyncs.pending[path] = true
+	time.AfterFunc(time.Second, func() {
+		aofSyncs.Lock()
+		delete(aofSyncs.pending, path)
+		aofSyncs.Unlock()
+		if f, err := os.OpenFile(path, os.O_WRONLY, 0644); err == nil {
+			f.Sync()
+			f.Close()
+		}
+	})
+}
+
+// compactKV écrit l'état complet dans kv.json et supprime le journal.
+func compactKV(databaseName string, store *kvStore, config KVConfig) error {
+	content, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fs.GetKVFilePath(databaseName)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if config.Fsync != "no" {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.GetKVAOFPath(databaseName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func writeAOFRecord(buf *bytes.Buffer, args ...string) {
+	fmt.Fprintf(buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
@@ -0,0 +1,420 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+// ZMember est un membre d'un ensemble trié avec son score.
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// zScore est le score enregistré d'un membre. JSON ne représente pas les
+// infinis acceptés par ZADD : ils sont écrits "+inf" et "-inf".
+type zScore float64
+
+func (s zScore) MarshalJSON() ([]byte, error) {
+	switch {
+	case math.IsInf(float64(s), 1):
+		return []byte(`"+inf"`), nil
+	case math.IsInf(float64(s), -1):
+		return []byte(`"-inf"`), nil
+	}
+	return json.Marshal(float64(s))
+}
+
+func (s *zScore) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		score, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("score invalide : \"%s\"", text)
+		}
+		*s = zScore(score)
+		return nil
+	}
+	var score float64
+	if err := json.Unmarshal(data, &score); err != nil {
+		return err
+	}
+	*s = zScore(score)
+	return nil
+}
+
+// KVType retourne le type de la valeur d'une clé, ou "none" si elle
+// n'existe pas.
+func KVType(databaseName, key string) (string, error) {
+	kind := "none"
+	err := viewKV(databaseName, func(store *kvStore) error {
+		if entry := store.lookup(key); entry != nil {
+			kind = entry.Type
+		}
+		return nil
+	})
+	return kind, err
+}
+
+// KVKeyCounts compte les clés de la base par type.
+func KVKeyCounts(databaseName string) (map[string]int, error) {
+	counts := map[string]int{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		for key := range store.Keys {
+			if entry := store.lookup(key); entry != nil {
+				counts[entry.Type]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// KVHSet enregistre des champs d'un hash et retourne le nombre de champs
+// créés.
+func KVHSet(databaseName, key string, fields map[string]string) (int, error) {
+	added := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.getOrCreate(key, kvTypeHash)
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			if _, ok := entry.Hash[field]; !ok {
+				added++
+			}
+			entry.Hash[field] = value
+		}
+		return nil
+	})
+	return added, err
+}
+
+func KVHGet(databaseName, key, field string) (string, bool, error) {
+	value, ok := "", false
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeHash)
+		if err != nil || entry == nil {
+			return err
+		}
+		value, ok = entry.Hash[field]
+		return nil
+	})
+	return value, ok, err
+}
+
+func KVHGetAll(databaseName, key string) (map[string]string, error) {
+	fields := map[string]string{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeHash)
+		if err != nil || entry == nil {
+			return err
+		}
+		fields = maps.Clone(entry.Hash)
+		return nil
+	})
+	return fields, err
+}
+
+// KVLPush ajoute des valeurs en tête de liste, une à une comme LPUSH (la
+// dernière se retrouve en premier), et retourne la longueur de la liste.
+func KVLPush(databaseName, key string, values ...string) (int, error) {
+	return kvPush(databaseName, key, values, true)
+}
+
+// KVRPush ajoute des valeurs en fin de liste et retourne sa longueur.
+func KVRPush(databaseName, key string, values ...string) (int, error) {
+	return kvPush(databaseName, key, values, false)
+}
+
+func kvPush(databaseName, key string, values []string, left bool) (int, error) {
+	length := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.getOrCreate(key, kvTypeList)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if left {
+				entry.List = append([]string{value}, entry.List...)
+			} else {
+				entry.List = append(entry.List, value)
+			}
+		}
+		length = len(entry.List)
+		return nil
+	})
+	return length, err
+}
+
+// KVLPop retire et retourne le premier élément de la liste.
+func KVLPop(databaseName, key string) (string, bool, error) {
+	return kvPop(databaseName, key, true)
+}
+
+// KVRPop retire et retourne le dernier élément de la liste.
+func KVRPop(databaseName, key string) (string, bool, error) {
+	return kvPop(databaseName, key, false)
+}
+
+func kvPop(databaseName, key string, left bool) (string, bool, error) {
+	value, found := "", false
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeList)
+		if err != nil || entry == nil {
+			return err
+		}
+		store.touch(key)
+		if left {
+			value, entry.List = entry.List[0], entry.List[1:]
+		} else {
+			value, entry.List = entry.List[len(entry.List)-1], entry.List[:len(entry.List)-1]
+		}
+		found = true
+		store.dropIfEmpty(key)
+		return nil
+	})
+	return value, found, err
+}
+
+// KVLRange retourne les éléments de start à stop inclus ; les indices
+// négatifs partent de la fin (-1 est le dernier élément).
+func KVLRange(databaseName, key string, start, stop int) ([]string, error) {
+	items := []string{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeList)
+		if err != nil || entry == nil {
+			return err
+		}
+		if from, to, ok := rangeBounds(len(entry.List), start, stop); ok {
+			items = slices.Clone(entry.List[from : to+1])
+		}
+		return nil
+	})
+	return items, err
+}
+
+// KVSAdd ajoute des membres à un ensemble et retourne le nombre de membres
+// nouveaux.
+func KVSAdd(databaseName, key string, members ...string) (int, error) {
+	added := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.getOrCreate(key, kvTypeSet)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if !entry.Set[member] {
+				entry.Set[member] = true
+				added++
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// KVSRem retire des membres d'un ensemble et retourne le nombre de membres
+// retirés.
+func KVSRem(databaseName, key string, members ...string) (int, error) {
+	removed := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeSet)
+		if err != nil || entry == nil {
+			return err
+		}
+		store.touch(key)
+		for _, member := range members {
+			if entry.Set[member] {
+				delete(entry.Set, member)
+				removed++
+			}
+		}
+		store.dropIfEmpty(key)
+		return nil
+	})
+	return removed, err
+}
+
+// KVSMembers retourne les membres d'un ensemble, triés.
+func KVSMembers(databaseName, key string) ([]string, error) {
+	return KVSInter(databaseName, key)
+}
+
+// KVSInter retourne l'intersection des ensembles, triée. Une clé absente
+// compte comme un ensemble vide.
+func KVSInter(databaseName string, keys ...string) ([]string, error) {
+	members := []string{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		sets := make([]map[string]bool, 0, len(keys))
+		for _, key := range keys {
+			entry, err := store.get(key, kvTypeSet)
+			if err != nil || entry == nil {
+				return err
+			}
+			sets = append(sets, entry.Set)
+		}
+		if len(sets) == 0 {
+			return nil
+		}
+		for member := range sets[0] {
+			inAll := true
+			for _, set := range sets[1:] {
+				if !set[member] {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				members = append(members, member)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// KVZAdd ajoute ou met à jour des membres d'un ensemble trié et retourne le
+// nombre de membres nouveaux.
+func KVZAdd(databaseName, key string, members ...ZMember) (int, error) {
+	added := 0
+	err := updateKV(databaseName, func(store *kvStore) error {
+		entry, err := store.getOrCreate(key, kvTypeZSet)
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if _, ok := entry.ZSet[m.Member]; !ok {
+				added++
+			}
+			entry.ZSet[m.Member] = zScore(m.Score)
+		}
+		return nil
+	})
+	return added, err
+}
+
+// KVZRange retourne les membres de rang start à stop inclus, par score
+// croissant (indices négatifs comme KVLRange).
+func KVZRange(databaseName, key string, start, stop int) ([]ZMember, error) {
+	members, err := kvZMembers(databaseName, key)
+	if err != nil {
+		return nil, err
+	}
+	from, to, ok := rangeBounds(len(members), start, stop)
+	if !ok {
+		return []ZMember{}, nil
+	}
+	return members[from : to+1], nil
+}
+
+// KVZRangeByScore retourne les membres dont le score est compris entre min
+// et max inclus, par score croissant.
+func KVZRangeByScore(databaseName, key string, min, max float64) ([]ZMember, error) {
+	members, err := kvZMembers(databaseName, key)
+	if err != nil {
+		return nil, err
+	}
+	result := []ZMember{}
+	for _, m := range members {
+		if m.Score >= min && m.Score <= max {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+func kvZMembers(databaseName, key string) ([]ZMember, error) {
+	members := []ZMember{}
+	err := viewKV(databaseName, func(store *kvStore) error {
+		entry, err := store.get(key, kvTypeZSet)
+		if err != nil || entry == nil {
+			return err
+		}
+		for member, score := range entry.ZSet {
+			members = append(members, ZMember{Member: member, Score: float64(score)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Score != members[j].Score {
+			return members[i].Score < members[j].Score
+		}
+		return members[i].Member < members[j].Member
+	})
+	return members, nil
+}
+
+// getOrCreate retourne l'entrée de la clé, créée vide si elle n'existe pas,
+// et la signale comme modifiée.
+func (s *kvStore) getOrCreate(key, kind string) (*kvEntry, error) {
+	entry, err := s.get(key, kind)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		s.touch(key)
+		return entry, nil
+	}
+	entry = &kvEntry{Type: kind}
+	switch kind {
+	case kvTypeHash:
+		entry.Hash = map[string]string{}
+	case kvTypeSet:
+		entry.Set = map[string]bool{}
+	case kvTypeZSet:
+		entry.ZSet = map[string]zScore{}
+	case kvTypeList:
+	default:
+		return nil, fmt.Errorf("type de valeur inconnu : %s", kind)
+	}
+	s.put(key, entry)
+	return entry, nil
+}
+
+// dropIfEmpty supprime la clé si sa collection est vide, comme Redis.
+func (s *kvStore) dropIfEmpty(key string) {
+	entry, ok := s.Keys[key]
+	if !ok {
+		return
+	}
+	if len(entry.Hash)+len(entry.List)+len(entry.Set)+len(entry.ZSet) == 0 && entry.Type != kvTypeString {
+		s.remove(key)
+	}
+}
+
+// rangeBounds convertit des indices inclusifs, éventuellement négatifs, en
+// bornes valides pour une collection de taille n.
+func rangeBounds(n, start, stop int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
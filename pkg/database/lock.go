@@ -0,0 +1,138 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"github.com/lucsky/cuid"
+)
+
+const (
+	lockRetryDelay = 10 * time.Millisecond
+	lockTimeout    = 5 * time.Second
+	lockStaleAfter = 30 * time.Second
+	// lockRefreshInterval espace les rafraîchissements d'un verrou ou d'une
+	// marque tenus : seul un fichier abandonné dépasse lockStaleAfter.
+	lockRefreshInterval = lockStaleAfter / 3
+)
+
+// lockTable prend le verrou d'écriture d'une table, partagé entre les
+// processus via un fichier créé de façon exclusive. Le verrou est rafraîchi
+// tant qu'il est tenu ; un verrou qui ne l'est plus depuis lockStaleAfter
+// est considéré comme abandonné et repris.
+func lockTable(databaseName, tableName string) (func(), error) {
+	return lockFile(tableLockPath(databaseName, tableName))
+}
+
+func tableLockPath(databaseName, tableName string) string {
+	return filepath.Join("./../../databases", databaseName, "."+tableName+".lock")
+}
+
+func lockFile(path string) (func(), error) {
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		unlock, err := tryLockFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if unlock != nil {
+			return unlock, nil
+		}
+
+		if removeStaleLock(path) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("délai dépassé en attendant le verrou %s", path)
+		}
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+// tryLockFile crée le verrou s'il est libre et retourne la fonction qui le
+// libère, nil s'il est déjà tenu. Le fichier contient un jeton propre au
+// détenteur : le verrou n'est rafraîchi et supprimé que s'il le contient
+// encore, pour ne jamais toucher au verrou d'un autre.
+func tryLockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("impossible de prendre le verrou %s : %v", path, err)
+	}
+	token := fmt.Sprintf("%d %s", os.Getpid(), cuid.New())
+	_, err = f.WriteString(token)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("impossible de prendre le verrou %s : %v", path, err)
+	}
+	stop := keepAlive(path, token)
+	return func() {
+		stop()
+		if content, err := os.ReadFile(path); err == nil && string(content) == token {
+			os.Remove(path)
+		}
+	}, nil
+}
+
+// removeStaleLock supprime le verrou s'il n'est plus rafraîchi depuis
+// lockStaleAfter. Le contenu est relu juste avant la suppression : un verrou
+// repris entre-temps par un autre processus est laissé en place.
+func removeStaleLock(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) <= lockStaleAfter {
+		return false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	if err != nil || !os.SameFile(info, current) || !current.ModTime().Equal(info.ModTime()) {
+		return false
+	}
+	if again, err := os.ReadFile(path); err != nil || string(again) != string(content) {
+		return false
+	}
+	return os.Remove(path) == nil
+}
+
+// tryLockTable prend le verrou de la table s'il est libre, sans attendre.
+// ok vaut false si le verrou est déjà tenu, par exemple par une écriture en
+// cours du même processus.
+func tryLockTable(databaseName, tableName string) (unlock func(), ok bool) {
+	unlock, err := tryLockFile(tableLockPath(databaseName, tableName))
+	if err != nil || unlock == nil {
+		return nil, false
+	}
+	return unlock, true
+}
+
+// keepAlive rafraîchit la date de modification du fichier tant qu'il contient
+// token, jusqu'à l'appel de la fonction retournée. Un fichier dont la date
+// n'avance plus appartient à un processus arrêté.
+func keepAlive(path, token string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if content, err := os.ReadFile(path); err == nil && string(content) == token {
+					os.Chtimes(path, now, now)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
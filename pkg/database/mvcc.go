@@ -0,0 +1,476 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+	"github.com/lucsky/cuid"
+)
+
+// Contrôle de concurrence multiversion. Chaque écriture reçoit un numéro de
+// validation (mvcc/clock) enregistré dans la ligne (_xmin) ; pendant
+// l'écriture, mvcc/active/<numéro> la signale comme en cours. Avant d'être
+// remplacée ou effacée, la version courante d'une ligne est recopiée dans
+// mvcc/versions/<table>/<id>.json avec le numéro qui l'a remplacée (xmax).
+//
+// Un lecteur prend un instantané : le dernier numéro attribué et les
+// écritures en cours. Il voit les versions écrites par une validation
+// terminée avant lui et pas encore remplacées de son point de vue, sans
+// bloquer les écritures. Les instantanés ouverts sont enregistrés dans
+// mvcc/snapshots/ pour que Vacuum ne supprime que les versions qu'aucun
+// lecteur ne peut plus voir.
+const xminField = "_xmin"
+
+// maxSnapshotAge est la durée au-delà de laquelle un instantané non libéré
+// (processus arrêté) n'empêche plus le nettoyage des versions.
+const maxSnapshotAge = time.Hour
+
+// Snapshot est l'état de la base vu par un lecteur.
+type Snapshot struct {
+	databaseName string
+	seq          int64
+	active       map[int64]bool
+	marker       string
+}
+
+// mvccVersion est une version remplacée d'une ligne, visible pour les
+// instantanés qui voient xmin mais pas xmax.
+type mvccVersion struct {
+	Data map[string]string `json:"data"`
+	Xmin int64             `json:"xmin"`
+	Xmax int64             `json:"xmax"`
+}
+
+// TakeSnapshot prend un instantané de la base. Il doit être libéré avec
+// Release.
+func TakeSnapshot(databaseName string) (*Snapshot, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	dir := fs.GetMVCCDirPath(databaseName)
+	if err := os.MkdirAll(filepath.Join(dir, "snapshots"), 0755); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(filepath.Join(dir, "clock.lock"))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	seq, err := readClock(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	active, err := activeCommits(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{databaseName: databaseName, seq: seq, active: active}
+	snapshot.marker = filepath.Join(dir, "snapshots", cuid.New())
+	low := strconv.FormatInt(snapshot.low(), 10)
+	if err := os.WriteFile(snapshot.marker, []byte(low), 0644); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Release libère l'instantané. Il peut être appelé plusieurs fois.
+func (s *Snapshot) Release() {
+	if s == nil || s.marker == "" {
+		return
+	}
+	os.Remove(s.marker)
+	s.marker = ""
+}
+
+// visible indique si l'écriture numéro xmin était validée à la prise de
+// l'instantané. 0 désigne une ligne écrite avant l'activation du MVCC.
+func (s *Snapshot) visible(xmin int64) bool {
+	return xmin == 0 || (xmin <= s.seq && !s.active[xmin])
+}
+
+// low est le plus petit numéro que l'instantané ne voit pas : les versions
+// remplacées avant lui ne lui servent plus.
+func (s *Snapshot) low() int64 {
+	low := s.seq + 1
+	for seq := range s.active {
+		if seq < low {
+			low = seq
+		}
+	}
+	return low
+}
+
+// resolve retourne la version de la ligne visible dans l'instantané, nil si
+// elle n'existait pas. current est la ligne sur le disque (nil si absente).
+func (s *Snapshot) resolve(tableName, id string, current map[string]string) (map[string]string, error) {
+	if current != nil && s.visible(rowXmin(current)) {
+		return current, nil
+	}
+	versions, err := loadVersions(s.databaseName, tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if s.visible(versions[i].Xmin) && !s.visible(versions[i].Xmax) {
+			return versions[i].Data, nil
+		}
+	}
+	return nil, nil
+}
+
+// beginCommit attribue un numéro de validation et la marque comme en cours
+// jusqu'à l'appel de la fonction retournée.
+func beginCommit(databaseName string) (int64, func(), error) {
+	dir := fs.GetMVCCDirPath(databaseName)
+	if err := os.MkdirAll(filepath.Join(dir, "active"), 0755); err != nil {
+		return 0, nil, err
+	}
+	unlock, err := lockFile(filepath.Join(dir, "clock.lock"))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer unlock()
+
+	seq, err := readClock(databaseName)
+	if err != nil {
+		return 0, nil, err
+	}
+	seq++
+	if err := writeFileAtomic(filepath.Join(dir, "clock"), []byte(strconv.FormatInt(seq, 10))); err != nil {
+		return 0, nil, err
+	}
+	marker := filepath.Join(dir, "active", strconv.FormatInt(seq, 10))
+	token := strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(marker, []byte(token), 0644); err != nil {
+		return 0, nil, err
+	}
+	stop := keepAlive(marker, token)
+	return seq, func() {
+		stop()
+		forgetHorizon(databaseName, seq)
+		os.Remove(marker)
+	}, nil
+}
+
+// withCommit exécute fn dans une validation d'une seule écriture.
+func withCommit(databaseName string, fn func(seq int64) error) error {
+	seq, end, err := beginCommit(databaseName)
+	if err != nil {
+		return err
+	}
+	defer end()
+	return fn(seq)
+}
+
+func readClock(databaseName string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(fs.GetMVCCDirPath(databaseName), "clock"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	seq, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("mvcc/clock mal formé : %v", err)
+	}
+	return seq, nil
+}
+
+// activeCommits retourne les écritures en cours. La marque d'une écriture
+// en cours est rafraîchie (voir keepAlive) : une marque qui ne l'est plus
+// depuis lockStaleAfter vient d'un processus arrêté et est supprimée.
+func activeCommits(databaseName string) (map[int64]bool, error) {
+	dir := filepath.Join(fs.GetMVCCDirPath(databaseName), "active")
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	active := map[int64]bool{}
+	for _, file := range files {
+		seq, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+		if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		active[seq] = true
+	}
+	return active, nil
+}
+
+// vacuumHorizon retourne le numéro en dessous duquel une version remplacée
+// n'est plus visible par aucun instantané ni aucune écriture en cours.
+func vacuumHorizon(databaseName string) (int64, error) {
+	seq, err := readClock(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	active, err := activeCommits(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	horizon := (&Snapshot{seq: seq, active: active}).low()
+
+	dir := filepath.Join(fs.GetMVCCDirPath(databaseName), "snapshots")
+	files, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > maxSnapshotAge {
+			os.Remove(path)
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if low, err := strconv.ParseInt(string(content), 10, 64); err == nil && low < horizon {
+			horizon = low
+		}
+	}
+	return horizon, nil
+}
+
+// keepVersion recopie la version courante d'une ligne avant son
+// remplacement par l'écriture seq, et retire les versions devenues
+// inutiles. Appelée sous le verrou de la table.
+func keepVersion(databaseName, tableName, id string, seq int64) error {
+	current, err := readRow(databaseName, tableName, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	versions, err := loadVersions(databaseName, tableName, id)
+	if err != nil {
+		return err
+	}
+	versions = append(versions, mvccVersion{Data: current, Xmin: rowXmin(current), Xmax: seq})
+	horizon, err := commitHorizon(databaseName, seq)
+	if err != nil {
+		return err
+	}
+	_, err = saveVersions(databaseName, tableName, id, versions, horizon)
+	return err
+}
+
+// commitHorizons garde l'horizon de nettoyage de chaque validation en cours :
+// il n'est calculé qu'une fois, à la première ligne remplacée. Un horizon un
+// peu ancien retire seulement moins de versions.
+var commitHorizons = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: map[string]int64{}}
+
+func commitHorizon(databaseName string, seq int64) (int64, error) {
+	key := databaseName + "/" + strconv.FormatInt(seq, 10)
+	commitHorizons.Lock()
+	horizon, ok := commitHorizons.m[key]
+	commitHorizons.Unlock()
+	if ok {
+		return horizon, nil
+	}
+	horizon, err := vacuumHorizon(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	commitHorizons.Lock()
+	commitHorizons.m[key] = horizon
+	commitHorizons.Unlock()
+	return horizon, nil
+}
+
+func forgetHorizon(databaseName string, seq int64) {
+	commitHorizons.Lock()
+	delete(commitHorizons.m, databaseName+"/"+strconv.FormatInt(seq, 10))
+	commitHorizons.Unlock()
+}
+
+// Vacuum supprime les versions remplacées qu'aucun lecteur ne peut plus voir
+// et retourne leur nombre.
+func Vacuum(databaseName string) (int, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return 0, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	dir := filepath.Join(fs.GetMVCCDirPath(databaseName), "versions")
+	tables, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, table := range tables {
+		if !table.IsDir() {
+			continue
+		}
+		n, err := vacuumTable(databaseName, table.Name())
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func vacuumTable(databaseName, tableName string) (int, error) {
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	horizon, err := vacuumHorizon(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	files, err := os.ReadDir(fs.GetVersionsDirPath(databaseName, tableName))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		id := strings.TrimSuffix(file.Name(), ".json")
+		versions, err := loadVersions(databaseName, tableName, id)
+		if err != nil {
+			return removed, err
+		}
+		n, err := saveVersions(databaseName, tableName, id, versions, horizon)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	os.Remove(fs.GetVersionsDirPath(databaseName, tableName))
+	return removed, nil
+}
+
+// StartVacuum lance Vacuum périodiquement jusqu'à l'annulation du contexte.
+func StartVacuum(ctx context.Context, databaseName string, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				Vacuum(databaseName)
+			}
+		}
+	}()
+}
+
+func loadVersions(databaseName, tableName, id string) ([]mvccVersion, error) {
+	content, err := os.ReadFile(fs.GetVersionsFile(databaseName, tableName, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var versions []mvccVersion
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("versions de \"%s\" illisibles : %v", id, err)
+	}
+	return versions, nil
+}
+
+// saveVersions enregistre les versions encore visibles (xmax >= horizon) et
+// retourne le nombre de versions retirées. Le fichier est supprimé s'il n'en
+// reste aucune.
+func saveVersions(databaseName, tableName, id string, versions []mvccVersion, horizon int64) (int, error) {
+	kept := []mvccVersion{}
+	for _, version := range versions {
+		if version.Xmax >= horizon {
+			kept = append(kept, version)
+		}
+	}
+	removed := len(versions) - len(kept)
+	path := fs.GetVersionsFile(databaseName, tableName, id)
+	if len(kept) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		return removed, nil
+	}
+	content, err := json.Marshal(kept)
+	if err != nil {
+		return removed, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return removed, err
+	}
+	return removed, writeFileAtomic(path, content)
+}
+
+// versionIDs retourne les ids des lignes de la table qui ont des versions
+// remplacées.
+func versionIDs(databaseName, tableName string) ([]string, error) {
+	files, err := os.ReadDir(fs.GetVersionsDirPath(databaseName, tableName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	ids := []string{}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// publicRow retourne la ligne sans son numéro de validation, interne à la
+// base.
+func publicRow(row map[string]string) map[string]string {
+	if row == nil || row[xminField] == "" {
+		return row
+	}
+	public := copyRow(row)
+	delete(public, xminField)
+	return public
+}
+
+func rowXmin(row map[string]string) int64 {
+	if row[xminField] == "" {
+		return 0
+	}
+	seq, err := strconv.ParseInt(row[xminField], 10, 64)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return seq
+}
+
+// writeFileAtomic remplace le fichier d'un coup : un lecteur voit l'ancien
+// ou le nouveau contenu, jamais un fichier à moitié écrit.
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
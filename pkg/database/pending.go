@@ -9,10 +9,11 @@ import (
 )
 
 type CachedQuery struct {
-	Action string            `json:"action"`
-	DBName string            `json:"dbName"`
-	Table  string            `json:"table"`
-	Data   map[string]string `json:"data"`
+	Action string              `json:"action"`
+	DBName string              `json:"dbName"`
+	Table  string              `json:"table"`
+	Data   map[string]string   `json:"data"`
+	Rows   []map[string]string `json:"rows,omitempty"`
 }
 
 func SaveQueryToCache(query CachedQuery) error {
@@ -62,6 +63,9 @@ func ExecutePendingTransaction(dbName string) error {
 	if err := json.Unmarshal(content, &tx); err != nil {
 		return fmt.Errorf("format pending invalide : %v", err)
 	}
+	if err := RebuildIndexes(dbName, tx.Table); err != nil {
+		return fmt.Errorf("échec de la reconstruction des index : %v", err)
+	}
 	switch tx.Action {
 	case "insert":
 		id := tx.Data["id"]
@@ -90,7 +94,7 @@ func ExecutePendingTransaction(dbName string) error {
 		}
 		upToDate := true
 		for k, v := range tx.Data {
-			if k == "id" {
+			if k == "id" || rowMetaFields[k] {
 				continue
 			}
 			fmt.Println(oldData[k], v)
@@ -99,23 +103,26 @@ func ExecutePendingTransaction(dbName string) error {
 				break
 			}
 		}
-		if upToDate {
+		// Une version plus récente sur le disque signifie que l'update a
+		// été appliqué (ou remplacé depuis) : le rejouer l'écraserait.
+		if upToDate || rowVersion(oldData) > rowVersion(tx.Data) {
 			fmt.Println("Update déjà effectué. Nettoyage du cache.")
+			return ClearCacheFile(dbName)
 		}
 		ClearCacheFile(dbName)
-		if err := UpdateData(tx.DBName, tx.Table, id, tx.Data); err != nil {
+		if err := writeRow(tx.DBName, tx.Table, oldData, tx.Data); err != nil {
 			return fmt.Errorf("échec update transactionnelle : %v", err)
 		}
-
-		if !upToDate {
-			fmt.Println("Update récupéré depuis pending.txt effectuée.")
-		}
+		fmt.Println("Update récupéré depuis pending.txt effectuée.")
 	case "delete":
 		id := tx.Data["id"]
 		if id == "" {
 			return fmt.Errorf("delete invalide : id manquant dans le cache")
 		}
 		exists := fs.DoesDataFileExist(dbName, tx.Table, id)
+		if old, err := readRow(dbName, tx.Table, id); err == nil && isDeleted(old) {
+			exists = false
+		}
 		if !exists {
 			fmt.Println("Suppression déjà effectuée. Nettoyage du cache.")
 			return ClearCacheFile(dbName)
@@ -124,6 +131,37 @@ func ExecutePendingTransaction(dbName string) error {
 			return fmt.Errorf("échec delete transactionnelle : %v", err)
 		}
 		fmt.Println("Suppression récupérée depuis pending.txt effectuée.")
+	case "update_many":
+		for _, row := range tx.Rows {
+			old, err := readRow(dbName, tx.Table, row["id"])
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("échec de lecture avant update : %v", err)
+			}
+			if err := writeRow(dbName, tx.Table, old, row); err != nil {
+				return fmt.Errorf("échec update groupé transactionnel : %v", err)
+			}
+		}
+		fmt.Printf("Mise à jour groupée de %d ligne(s) récupérée depuis pending.txt effectuée.\n", len(tx.Rows))
+	case "delete_many":
+		for _, row := range tx.Rows {
+			old, err := readRow(dbName, tx.Table, row["id"])
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return fmt.Errorf("échec de lecture avant suppression : %v", err)
+			}
+			if isDeleted(old) {
+				continue
+			}
+			if err := deleteRow(dbName, tx.Table, old); err != nil {
+				return fmt.Errorf("échec delete groupé transactionnel : %v", err)
+			}
+		}
+		fmt.Printf("Suppression groupée de %d ligne(s) récupérée depuis pending.txt effectuée.\n", len(tx.Rows))
 	default:
 		return fmt.Errorf("action inconnue : %s", tx.Action)
 	}
@@ -0,0 +1,275 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// Stmt est une requête préparée : les valeurs des conditions sont des
+// paramètres ($1, $2... ou ?) liés à chaque exécution. La table (ou la vue),
+// les types des champs et l'index utilisé sont résolus une seule fois par
+// Prepare. Une valeur liée n'est jamais interprétée : elle est comparée
+// telle quelle au champ.
+type Stmt struct {
+	query      Query
+	view       string
+	params     []stmtParam
+	slots      []int
+	access     int
+	accessKind string
+}
+
+type stmtParam struct {
+	Field string
+	Type  string
+}
+
+// Prepare prépare une requête dont les valeurs de conditions peuvent être
+// des paramètres. Les deux styles ne peuvent pas être mélangés : avec $n,
+// tous les numéros de 1 à n doivent être utilisés ; avec ?, les paramètres
+// sont numérotés dans l'ordre des conditions.
+//
+//	stmt, err := Prepare(Query{DBName: "shop", Table: "products", Conditions: []Condition{
+//		{Field: "price", Op: "<", Value: "$1"},
+//		{Field: "category", Op: "=", Value: "$2"},
+//	}})
+//	rows, err := stmt.Select(50, "books")
+func Prepare(query Query) (*Stmt, error) {
+	if !fs.DoesDirExist(query.DBName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", query.DBName)
+	}
+	schema, err := loadSchema(query.DBName)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &Stmt{access: -1}
+	fields, ok := schema[query.Table]
+	if !ok {
+		view, err := findView(query.DBName, query.Table)
+		if err != nil {
+			return nil, err
+		}
+		if view == nil {
+			return nil, fmt.Errorf("la table \"%s\" n'existe pas", query.Table)
+		}
+		if view.Materialized {
+			stmt.view = view.Name
+		} else {
+			query = view.expand(query)
+		}
+		fields = schema[view.Table]
+	}
+	stmt.query = query
+	types := fieldTypes(fields)
+
+	positional, numbered := false, false
+	stmt.slots = make([]int, len(query.Conditions))
+	for i, cond := range query.Conditions {
+		if _, ok := types[cond.Field]; !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", cond.Field, query.Table)
+		}
+		stmt.slots[i] = -1
+		fieldType := types[cond.Field]
+		if cond.Op == "MATCH" {
+			fieldType = "string"
+		}
+
+		switch {
+		case cond.Value == "?":
+			positional = true
+			if numbered {
+				break
+			}
+			stmt.slots[i] = len(stmt.params)
+			stmt.params = append(stmt.params, stmtParam{Field: cond.Field, Type: fieldType})
+		case strings.HasPrefix(cond.Value, "$"):
+			n, err := strconv.Atoi(cond.Value[1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("paramètre invalide : \"%s\"", cond.Value)
+			}
+			numbered = true
+			if positional {
+				break
+			}
+			for len(stmt.params) < n {
+				stmt.params = append(stmt.params, stmtParam{})
+			}
+			param := &stmt.params[n-1]
+			if param.Field != "" && param.Type != fieldType {
+				return nil, fmt.Errorf("le paramètre $%d est utilisé pour \"%s\" (%s) et \"%s\" (%s)", n, param.Field, param.Type, cond.Field, fieldType)
+			}
+			param.Field, param.Type = cond.Field, fieldType
+			stmt.slots[i] = n - 1
+		}
+	}
+	if positional && numbered {
+		return nil, fmt.Errorf("les paramètres ? et $n ne peuvent pas être mélangés")
+	}
+	for i, param := range stmt.params {
+		if param.Field == "" {
+			return nil, fmt.Errorf("le paramètre $%d n'est pas utilisé", i+1)
+		}
+	}
+
+	if stmt.view == "" {
+		if err := stmt.chooseAccess(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// chooseAccess retient l'index utilisé à chaque exécution. Sans les
+// valeurs, on ne peut pas comparer les sélectivités : une égalité est
+// préférée à une recherche plein texte, elle-même préférée à un intervalle.
+func (s *Stmt) chooseAccess() error {
+	rank := map[string]int{"index_lookup": 3, "fulltext_match": 2, "index_range": 1}
+	for i, cond := range s.query.Conditions {
+		idx, err := loadIndex(s.query.DBName, s.query.Table, cond.Field)
+		if err != nil {
+			return err
+		}
+		if idx == nil {
+			continue
+		}
+		kind := indexAccess(idx, cond.Op)
+		if kind != "" && rank[kind] > rank[s.accessKind] {
+			s.access, s.accessKind = i, kind
+		}
+	}
+	return nil
+}
+
+// NumInput retourne le nombre de paramètres attendus.
+func (s *Stmt) NumInput() int {
+	return len(s.params)
+}
+
+// Query exécute la requête avec les arguments donnés et retourne un curseur.
+func (s *Stmt) Query(ctx context.Context, args ...interface{}) (*Rows, error) {
+	start := time.Now()
+	plan, err := s.bind(args)
+	if err != nil {
+		return nil, err
+	}
+	return openRows(ctx, plan, start)
+}
+
+// Select exécute la requête et retourne toutes les lignes.
+func (s *Stmt) Select(args ...interface{}) ([]map[string]string, error) {
+	rows, err := s.Query(context.Background(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []map[string]string{}
+	for rows.Next() {
+		results = append(results, rows.Row())
+	}
+	return results, rows.Err()
+}
+
+// bind vérifie les arguments et construit le plan de l'exécution à partir
+// de l'accès choisi par Prepare.
+func (s *Stmt) bind(args []interface{}) (*Plan, error) {
+	if len(args) != len(s.params) {
+		return nil, fmt.Errorf("la requête attend %d paramètre(s), %d fourni(s)", len(s.params), len(args))
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		val, err := bindValue(arg, s.params[i])
+		if err != nil {
+			return nil, fmt.Errorf("paramètre %d : %v", i+1, err)
+		}
+		values[i] = val
+	}
+
+	query := Query{DBName: s.query.DBName, Table: s.query.Table, IncludeDeleted: s.query.IncludeDeleted}
+	for i, cond := range s.query.Conditions {
+		if s.slots[i] >= 0 {
+			cond.Value = values[s.slots[i]]
+		}
+		query.Conditions = append(query.Conditions, cond)
+	}
+
+	plan := &Plan{Kind: "full_scan", query: query}
+	if s.view != "" {
+		plan.Kind, plan.Index = "materialized_view", s.view
+	} else if s.access >= 0 {
+		cond := query.Conditions[s.access]
+		idx, err := loadIndex(query.DBName, query.Table, cond.Field)
+		if err != nil {
+			return nil, err
+		}
+		// L'index a pu être supprimé depuis Prepare : on repasse alors en
+		// parcours complet.
+		if idx != nil && indexAccess(idx, cond.Op) == s.accessKind {
+			plan.Kind = s.accessKind
+			plan.Index = fmt.Sprintf("%s.%s (%s)", idx.Table, idx.Field, idx.Kind)
+			plan.Condition = cond.String()
+			plan.ids = idx.accessIDs(cond)
+			plan.EstimatedRows = len(plan.ids)
+		}
+	}
+	for _, cond := range query.Conditions {
+		if cond.String() != plan.Condition {
+			plan.Filter = append(plan.Filter, cond.String())
+		}
+	}
+	return plan, nil
+}
+
+// bindValue convertit un argument Go en valeur de champ, en refusant les
+// types incompatibles avec le champ. Une chaîne est acceptée pour tout type
+// si elle en a le format. Le champ id accepte toute chaîne.
+func bindValue(arg interface{}, param stmtParam) (string, error) {
+	var val string
+	switch v := arg.(type) {
+	case string:
+		val = v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		if param.Type != "int" && param.Type != "float" {
+			return "", fmt.Errorf("entier fourni pour \"%s\" de type %s", param.Field, param.Type)
+		}
+		return fmt.Sprint(v), nil
+	case float32:
+		val = strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		val = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if param.Type != "bool" {
+			return "", fmt.Errorf("booléen fourni pour \"%s\" de type %s", param.Field, param.Type)
+		}
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("type %T non supporté pour \"%s\"", arg, param.Field)
+	}
+
+	if _, isString := arg.(string); !isString && param.Type != "float" {
+		return "", fmt.Errorf("décimal fourni pour \"%s\" de type %s", param.Field, param.Type)
+	}
+	if param.Field == "id" {
+		return val, nil
+	}
+	switch param.Type {
+	case "int":
+		if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return "", fmt.Errorf("\"%s\" n'est pas un entier valide pour \"%s\"", val, param.Field)
+		}
+	case "float":
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return "", fmt.Errorf("\"%s\" n'est pas un décimal valide pour \"%s\"", val, param.Field)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(val); err != nil {
+			return "", fmt.Errorf("\"%s\" n'est pas un booléen valide pour \"%s\"", val, param.Field)
+		}
+	}
+	return val, nil
+}
@@ -0,0 +1,359 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// Les messages publiés sont ajoutés à pubsub.log (une ligne JSON par
+// message) ; chaque abonnement lit la suite du fichier. Les abonnés d'un
+// autre processus (serveur Redis, `pubsub subscribe`) reçoivent donc aussi
+// les messages publiés par la CLI. Le fichier est vidé quand il dépasse
+// maxPubSubLogSize : un abonné en retard peut alors perdre des messages.
+const (
+	maxPubSubLogSize  = 1 << 20
+	pubSubPollDelay   = 100 * time.Millisecond
+	changeChannelBase = "changes:"
+)
+
+// Message est un message reçu par un abonnement. Pattern est le motif qui a
+// permis de le recevoir, vide pour un abonnement à un canal.
+type Message struct {
+	Channel string    `json:"channel"`
+	Pattern string    `json:"-"`
+	Payload string    `json:"payload"`
+	Time    time.Time `json:"time"`
+}
+
+// ChangeEvent est publié sur le canal changes:<table> à chaque écriture
+// d'une ligne. Fields liste les champs modifiés (tous pour une insertion ou
+// une suppression).
+type ChangeEvent struct {
+	Op        string    `json:"op"`
+	Database  string    `json:"database"`
+	Table     string    `json:"table"`
+	ID        string    `json:"id"`
+	Fields    []string  `json:"fields"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Subscription reçoit sur C les messages des canaux et motifs auxquels elle
+// est abonnée, jusqu'à Close.
+type Subscription struct {
+	C <-chan Message
+
+	databaseName string
+	messages     chan Message
+	done         chan struct{}
+	closeOnce    sync.Once
+	mu           sync.Mutex
+	channels     map[string]bool
+	patterns     map[string]bool
+}
+
+// Abonnements du processus, pour le nombre de destinataires retourné par
+// Publish.
+var subscriptions = struct {
+	sync.Mutex
+	all map[*Subscription]bool
+}{all: map[*Subscription]bool{}}
+
+// Publish publie un message et retourne le nombre d'abonnements du
+// processus qui le recevront.
+func Publish(databaseName, channel, payload string) (int, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return 0, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	line, err := json.Marshal(Message{Channel: channel, Payload: payload, Time: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	filePath := fs.GetPubSubLogPath(databaseName)
+	unlock, err := lockFile(filePath + ".lock")
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if info, err := os.Stat(filePath); err == nil && info.Size() > maxPubSubLogSize {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return countReceivers(databaseName, channel), nil
+}
+
+// Subscribe crée un abonnement, sans canal, aux messages publiés à partir de
+// maintenant dans la base.
+func Subscribe(databaseName string) (*Subscription, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	offset := int64(0)
+	if info, err := os.Stat(fs.GetPubSubLogPath(databaseName)); err == nil {
+		offset = info.Size()
+	}
+	messages := make(chan Message, 256)
+	sub := &Subscription{
+		C:            messages,
+		databaseName: databaseName,
+		messages:     messages,
+		done:         make(chan struct{}),
+		channels:     map[string]bool{},
+		patterns:     map[string]bool{},
+	}
+	subscriptions.Lock()
+	subscriptions.all[sub] = true
+	subscriptions.Unlock()
+	go sub.tail(offset)
+	return sub, nil
+}
+
+// Subscribe ajoute des canaux et retourne le nombre total d'abonnements
+// (canaux et motifs).
+func (s *Subscription) Subscribe(channels ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// PSubscribe ajoute des motifs (*, ? et [...]) et retourne le nombre total
+// d'abonnements.
+func (s *Subscription) PSubscribe(patterns ...string) (int, error) {
+	for _, pattern := range patterns {
+		if err := checkGlob(pattern); err != nil {
+			return 0, err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pattern := range patterns {
+		s.patterns[pattern] = true
+	}
+	return len(s.channels) + len(s.patterns), nil
+}
+
+// Unsubscribe retire des canaux (tous si aucun n'est donné) et retourne
+// les canaux retirés.
+func (s *Subscription) Unsubscribe(channels ...string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return removeSubscriptions(s.channels, channels)
+}
+
+// PUnsubscribe retire des motifs (tous si aucun n'est donné) et retourne
+// les motifs retirés.
+func (s *Subscription) PUnsubscribe(patterns ...string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return removeSubscriptions(s.patterns, patterns)
+}
+
+// Count retourne le nombre de canaux et de motifs de l'abonnement.
+func (s *Subscription) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels) + len(s.patterns)
+}
+
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		subscriptions.Lock()
+		delete(subscriptions.all, s)
+		subscriptions.Unlock()
+	})
+}
+
+// match retourne les messages à remettre pour un message publié : un pour
+// le canal et un par motif correspondant, comme Redis.
+func (s *Subscription) match(msg Message) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matched := []Message{}
+	if s.channels[msg.Channel] {
+		matched = append(matched, msg)
+	}
+	patterns := make([]string, 0, len(s.patterns))
+	for pattern := range s.patterns {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for _, pattern := range patterns {
+		if globMatch(pattern, msg.Channel) {
+			withPattern := msg
+			withPattern.Pattern = pattern
+			matched = append(matched, withPattern)
+		}
+	}
+	return matched
+}
+
+// tail lit les messages ajoutés au journal à partir de offset et remet sur
+// C ceux qui correspondent à l'abonnement.
+func (s *Subscription) tail(offset int64) {
+	defer close(s.messages)
+	ticker := time.NewTicker(pubSubPollDelay)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		lines, next := readPubSubLog(s.databaseName, offset)
+		offset = next
+		for _, line := range lines {
+			var msg Message
+			if err := json.Unmarshal(line, &msg); err != nil {
+				continue
+			}
+			for _, m := range s.match(msg) {
+				select {
+				case s.messages <- m:
+				case <-s.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+// readPubSubLog retourne les lignes complètes écrites après offset et la
+// position suivante. Un journal plus court que offset a été vidé : la
+// lecture reprend au début.
+func readPubSubLog(databaseName string, offset int64) ([][]byte, int64) {
+	f, err := os.Open(fs.GetPubSubLogPath(databaseName))
+	if err != nil {
+		return nil, 0
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, offset
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if info.Size() == offset {
+		return nil, offset
+	}
+	content := make([]byte, info.Size()-offset)
+	n, err := f.ReadAt(content, offset)
+	if err != nil && err != io.EOF {
+		return nil, offset
+	}
+	content = content[:n]
+	end := bytes.LastIndexByte(content, '\n')
+	if end < 0 {
+		return nil, offset
+	}
+	return bytes.Split(content[:end], []byte("\n")), offset + int64(end) + 1
+}
+
+func countReceivers(databaseName, channel string) int {
+	subscriptions.Lock()
+	defer subscriptions.Unlock()
+	count := 0
+	for sub := range subscriptions.all {
+		if sub.databaseName == databaseName {
+			count += len(sub.match(Message{Channel: channel}))
+		}
+	}
+	return count
+}
+
+func removeSubscriptions(current map[string]bool, names []string) []string {
+	if len(names) == 0 {
+		for name := range current {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	removed := []string{}
+	for _, name := range names {
+		if current[name] {
+			delete(current, name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// publishChange publie l'écriture d'une ligne sur changes:<table>. Une
+// suppression logique est publiée comme une suppression, et sa
+// restauration comme "restore" ; op remplace l'opération déduite
+// (expiration). L'écriture a déjà réussi : une erreur de publication est
+// ignorée.
+func publishChange(databaseName, tableName, op string, old, entry map[string]string) {
+	event := ChangeEvent{Database: databaseName, Table: tableName, Timestamp: time.Now()}
+	switch {
+	case old == nil:
+		event.Op, event.ID, event.Fields = "insert", entry["id"], rowFields(entry)
+	case entry == nil:
+		event.Op, event.ID, event.Fields = "delete", old["id"], rowFields(old)
+	case isDeleted(entry) && !isDeleted(old):
+		event.Op, event.ID, event.Fields = "delete", entry["id"], rowFields(old)
+	case isDeleted(old) && !isDeleted(entry):
+		event.Op, event.ID, event.Fields = "restore", entry["id"], rowFields(entry)
+	default:
+		event.Op, event.ID = "update", entry["id"]
+		for field := range entry {
+			if !rowMetaFields[field] && old[field] != entry[field] {
+				event.Fields = append(event.Fields, field)
+			}
+		}
+		for field := range old {
+			if _, ok := entry[field]; !ok {
+				event.Fields = append(event.Fields, field)
+			}
+		}
+		if len(event.Fields) == 0 {
+			return
+		}
+		sort.Strings(event.Fields)
+	}
+	if op != "" {
+		event.Op = op
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	Publish(databaseName, changeChannelBase+tableName, string(payload))
+}
+
+// rowMetaFields sont tenus par la base à chaque écriture : ils ne sont pas
+// signalés comme modifiés.
+var rowMetaFields = map[string]bool{xminField: true, versionField: true, updatedAtField: true}
+
+func rowFields(row map[string]string) []string {
+	fields := make([]string, 0, len(row))
+	for field := range row {
+		if field != deletedAtField && !rowMetaFields[field] {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,376 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+var conditionOperators = []string{">=", "<=", "!=", ">", "<", "="}
+
+type Condition struct {
+	Field string `json:"field"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+}
+
+// Query décrit une sélection. Les lignes supprimées logiquement ne sont
+// retournées qu'avec IncludeDeleted.
+type Query struct {
+	DBName         string      `json:"dbName"`
+	Table          string      `json:"table"`
+	Conditions     []Condition `json:"conditions"`
+	IncludeDeleted bool        `json:"include_deleted,omitempty"`
+
+	// snapshot est l'instantané à lire (celui d'une transaction) ; latest
+	// lit l'état courant sans instantané.
+	snapshot *Snapshot
+	latest   bool
+}
+
+// Plan décrit la façon dont une requête est exécutée : parcours complet de
+// la table, recherche dans un index hash/btree ou parcours d'intervalle btree.
+type Plan struct {
+	Kind          string        `json:"kind"`
+	Index         string        `json:"index,omitempty"`
+	Condition     string        `json:"condition,omitempty"`
+	Filter        []string      `json:"filter,omitempty"`
+	TotalRows     int           `json:"total_rows"`
+	EstimatedRows int           `json:"estimated_rows"`
+	Analyzed      bool          `json:"analyzed"`
+	ScannedRows   int           `json:"scanned_rows,omitempty"`
+	ActualRows    int           `json:"actual_rows,omitempty"`
+	Duration      time.Duration `json:"duration,omitempty"`
+
+	ids   []string
+	query Query
+}
+
+func (c Condition) String() string {
+	return c.Field + " " + c.Op + " " + c.Value
+}
+
+// ParseCondition lit une condition de la forme champ<op>valeur, ou
+// "champ MATCH mots" pour une recherche plein texte. L'opérateur est le
+// premier rencontré (à deux caractères s'il y en a un à cette position) :
+// la valeur peut contenir d'autres opérateurs ("note=a>b").
+func ParseCondition(expr string) (Condition, error) {
+	if idx := strings.Index(strings.ToLower(expr), " match "); idx > 0 {
+		return Condition{
+			Field: strings.TrimSpace(expr[:idx]),
+			Op:    "MATCH",
+			Value: strings.Trim(strings.TrimSpace(expr[idx+len(" match "):]), "\"'"),
+		}, nil
+	}
+	for idx := 1; idx < len(expr); idx++ {
+		for _, op := range conditionOperators {
+			if !strings.HasPrefix(expr[idx:], op) {
+				continue
+			}
+			return Condition{
+				Field: strings.TrimSpace(expr[:idx]),
+				Op:    op,
+				Value: strings.TrimSpace(expr[idx+len(op):]),
+			}, nil
+		}
+	}
+	return Condition{}, fmt.Errorf("condition invalide : '%s' (format attendu: champ<op>valeur)", expr)
+}
+
+func equalityConditions(whereClauses map[string]string) []Condition {
+	conditions := []Condition{}
+	for field, value := range whereClauses {
+		conditions = append(conditions, Condition{Field: field, Op: "=", Value: value})
+	}
+	sort.Slice(conditions, func(i, j int) bool {
+		return conditions[i].Field < conditions[j].Field
+	})
+	return conditions
+}
+
+// PlanQuery choisit le plan le moins coûteux parmi le parcours complet et
+// les index disponibles sur les champs filtrés, en estimant le nombre de
+// lignes retournées à partir du nombre de lignes de la table et des index.
+func PlanQuery(query Query) (*Plan, error) {
+	if !fs.DoesDirExist(query.DBName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", query.DBName)
+	}
+	schema, err := loadSchema(query.DBName)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := schema[query.Table]
+	if !ok {
+		view, err := findView(query.DBName, query.Table)
+		if err != nil {
+			return nil, err
+		}
+		if view == nil {
+			return nil, fmt.Errorf("la table \"%s\" n'existe pas", query.Table)
+		}
+		if !view.Materialized {
+			return PlanQuery(view.expand(query))
+		}
+		types := fieldTypes(schema[view.Table])
+		plan := &Plan{Kind: "materialized_view", Index: view.Name, query: query}
+		for _, cond := range query.Conditions {
+			if _, ok := types[cond.Field]; !ok {
+				return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la vue \"%s\"", cond.Field, view.Name)
+			}
+			plan.Filter = append(plan.Filter, cond.String())
+		}
+		return plan, nil
+	}
+	types := fieldTypes(fields)
+	for _, cond := range query.Conditions {
+		if _, ok := types[cond.Field]; !ok {
+			return nil, fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", cond.Field, query.Table)
+		}
+	}
+
+	totalRows, err := countRows(query.DBName, query.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Kind:          "full_scan",
+		TotalRows:     totalRows,
+		EstimatedRows: estimateScanRows(totalRows, query.Conditions),
+		query:         query,
+	}
+	bestCost := totalRows
+
+	for _, cond := range query.Conditions {
+		idx, err := loadIndex(query.DBName, query.Table, cond.Field)
+		if err != nil {
+			return nil, err
+		}
+		if idx == nil {
+			continue
+		}
+
+		kind := indexAccess(idx, cond.Op)
+		if kind == "" {
+			continue
+		}
+		ids := idx.accessIDs(cond)
+
+		if len(ids) < bestCost {
+			bestCost = len(ids)
+			plan.Kind = kind
+			plan.Index = fmt.Sprintf("%s.%s (%s)", idx.Table, idx.Field, idx.Kind)
+			plan.Condition = cond.String()
+			plan.EstimatedRows = len(ids)
+			plan.ids = ids
+		}
+	}
+
+	filters := []Condition{}
+	for _, cond := range query.Conditions {
+		if cond.String() != plan.Condition {
+			filters = append(filters, cond)
+			plan.Filter = append(plan.Filter, cond.String())
+		}
+	}
+	if plan.Kind != "full_scan" && plan.EstimatedRows > 0 && len(filters) > 0 {
+		plan.EstimatedRows = estimateScanRows(plan.EstimatedRows, filters)
+	}
+	return plan, nil
+}
+
+// indexAccess retourne le type d'accès que l'index permet pour l'opérateur
+// op, ou "" s'il ne peut pas servir.
+func indexAccess(idx *Index, op string) string {
+	switch {
+	case idx.Kind == "fulltext":
+		if op == "MATCH" {
+			return "fulltext_match"
+		}
+	case op == "=":
+		return "index_lookup"
+	case idx.Kind == "btree" && (op == ">" || op == ">=" || op == "<" || op == "<="):
+		return "index_range"
+	}
+	return ""
+}
+
+// accessIDs retourne les ids candidats pour la condition, à filtrer ensuite
+// par matchesConditions.
+func (idx *Index) accessIDs(cond Condition) []string {
+	switch {
+	case idx.Kind == "fulltext":
+		return idx.matchIDs(cond.Value)
+	case cond.Op == "=":
+		return idx.lookup(cond.Value)
+	case cond.Op == ">" || cond.Op == ">=":
+		return idx.rangeIDs(cond.Value, "")
+	}
+	return idx.rangeIDs("", cond.Value)
+}
+
+// SelectWhere exécute une requête à conditions multiples (=, !=, <, <=, >, >=,
+// MATCH) selon le plan retourné par PlanQuery. Les résultats ne sont pas mis en cache.
+func SelectWhere(query Query) ([]map[string]string, error) {
+	results, _, err := executeQuery(query)
+	return results, err
+}
+
+// selectLatest lit l'état courant des lignes, y compris une écriture en
+// cours : réservé aux écritures, qui tiennent le verrou de la table.
+func selectLatest(query Query) ([]map[string]string, error) {
+	query.latest = true
+	return SelectWhere(query)
+}
+
+// ExplainQuery retourne le plan de la requête. Avec analyze, la requête est
+// exécutée et le plan complété du nombre réel de lignes et de la durée.
+func ExplainQuery(query Query, analyze bool) (*Plan, error) {
+	if !analyze {
+		return PlanQuery(query)
+	}
+	_, plan, err := executeQuery(query)
+	return plan, err
+}
+
+func executeQuery(query Query) ([]map[string]string, *Plan, error) {
+	rows, err := QueryRows(context.Background(), query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	results := []map[string]string{}
+	for rows.Next() {
+		results = append(results, rows.Row())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return results, rows.Plan(), nil
+}
+
+func (p *Plan) String() string {
+	var b strings.Builder
+	switch p.Kind {
+	case "index_lookup":
+		fmt.Fprintf(&b, "Index Lookup sur %s\n", p.Index)
+		fmt.Fprintf(&b, "  Index Cond: %s\n", p.Condition)
+	case "index_range":
+		fmt.Fprintf(&b, "Index Range Scan sur %s\n", p.Index)
+		fmt.Fprintf(&b, "  Index Cond: %s\n", p.Condition)
+	case "materialized_view":
+		fmt.Fprintf(&b, "Materialized View Scan sur %s\n", p.Index)
+	case "fulltext_match":
+		fmt.Fprintf(&b, "Full-Text Match sur %s\n", p.Index)
+		fmt.Fprintf(&b, "  Index Cond: %s\n", p.Condition)
+	default:
+		fmt.Fprintf(&b, "Full Scan\n")
+	}
+	if len(p.Filter) > 0 {
+		fmt.Fprintf(&b, "  Filter: %s\n", strings.Join(p.Filter, " AND "))
+	}
+	if p.Kind != "materialized_view" {
+		if p.TotalRows > 0 {
+			fmt.Fprintf(&b, "  Lignes dans la table : %d\n", p.TotalRows)
+		}
+		fmt.Fprintf(&b, "  Lignes estimées : %d\n", p.EstimatedRows)
+	}
+	if p.Analyzed {
+		fmt.Fprintf(&b, "  Lignes lues : %d\n", p.ScannedRows)
+		fmt.Fprintf(&b, "  Lignes retournées : %d\n", p.ActualRows)
+		fmt.Fprintf(&b, "  Durée : %v\n", p.Duration)
+	}
+	return b.String()
+}
+
+func matchesConditions(entry map[string]string, conditions []Condition, types map[string]string, stemming map[string]bool) bool {
+	for _, cond := range conditions {
+		val, ok := entry[cond.Field]
+		if !ok {
+			return false
+		}
+		if cond.Op == "MATCH" {
+			if !matchesText(val, cond.Value, stemming[cond.Field]) {
+				return false
+			}
+			continue
+		}
+		cmp := compareIndexValues(val, cond.Value, types[cond.Field])
+		if cond.Op == "=" || cond.Op == "!=" {
+			cmp = strings.Compare(val, cond.Value)
+		}
+		switch cond.Op {
+		case "=":
+			ok = cmp == 0
+		case "!=":
+			ok = cmp != 0
+		case ">":
+			ok = cmp > 0
+		case ">=":
+			ok = cmp >= 0
+		case "<":
+			ok = cmp < 0
+		case "<=":
+			ok = cmp <= 0
+		default:
+			ok = false
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// estimateScanRows applique une sélectivité fixe par condition : 10% pour
+// une égalité, 90% pour une différence et un tiers pour une comparaison.
+func estimateScanRows(totalRows int, conditions []Condition) int {
+	estimate := float64(totalRows)
+	for _, cond := range conditions {
+		switch cond.Op {
+		case "=":
+			estimate *= 0.1
+		case "!=":
+			estimate *= 0.9
+		case "MATCH":
+			estimate *= 0.05
+		default:
+			estimate /= 3
+		}
+	}
+	if estimate < 1 && totalRows > 0 {
+		return 1
+	}
+	return int(estimate)
+}
+
+func listRowIDs(databaseName, tableName string) ([]string, error) {
+	files, err := os.ReadDir(fs.GetDataFilePath(databaseName, tableName))
+	if err != nil {
+		return nil, fmt.Errorf("impossible de lire le dossier table: %v", err)
+	}
+	ids := []string{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+	}
+	return ids, nil
+}
+
+func countRows(databaseName, tableName string) (int, error) {
+	ids, err := listRowIDs(databaseName, tableName)
+	if err != nil {
+		if _, statErr := os.Stat(fs.GetDataFilePath(databaseName, tableName)); os.IsNotExist(statErr) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return len(ids), nil
+}
@@ -0,0 +1,407 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// DatabaseSettings regroupe les options d'une base, enregistrées dans
+// settings.json.
+type DatabaseSettings struct {
+	Tables map[string]*TableSettings `json:"tables,omitempty"`
+	Cache  *CacheSettings            `json:"cache,omitempty"`
+	KV     *KVSettings               `json:"kv,omitempty"`
+}
+
+// KVSettings contient les options de persistance du stockage clé-valeur
+// telles qu'enregistrées ; une valeur vide prend la valeur par défaut.
+type KVSettings struct {
+	Persistence string `json:"persistence,omitempty"`
+	Fsync       string `json:"fsync,omitempty"`
+	AutoRewrite *int64 `json:"auto_rewrite,omitempty"`
+}
+
+// KVConfig est la configuration effective de la persistance du stockage
+// clé-valeur. AutoRewrite vaut 0 si la réécriture automatique est
+// désactivée.
+type KVConfig struct {
+	Persistence string
+	Fsync       string
+	AutoRewrite int64
+}
+
+// CacheSettings contient les options du cache des sélections telles
+// qu'enregistrées ; une valeur vide prend la valeur par défaut.
+type CacheSettings struct {
+	Disabled   bool   `json:"disabled,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	MaxEntries int    `json:"max_entries,omitempty"`
+	MaxBytes   int64  `json:"max_bytes,omitempty"`
+}
+
+// CacheConfig est la configuration effective du cache d'une base.
+type CacheConfig struct {
+	Enabled    bool
+	TTL        time.Duration
+	MaxEntries int
+	MaxBytes   int64
+}
+
+const (
+	defaultCacheTTL        = 10 * time.Minute
+	defaultCacheMaxEntries = 500
+	defaultCacheMaxBytes   = 8 << 20
+	defaultKVAutoRewrite   = 1 << 20
+)
+
+// TableSettings contient les options propres à une table.
+type TableSettings struct {
+	History      bool      `json:"history,omitempty"`
+	HistorySince time.Time `json:"history_since,omitempty"`
+	SoftDelete   bool      `json:"soft_delete,omitempty"`
+	Retention    string    `json:"retention,omitempty"`
+	TTL          string    `json:"ttl,omitempty"`
+	ExpiresField string    `json:"expires_field,omitempty"`
+}
+
+// SetTableOption modifie une option de la table :
+//   - history on|off : conserve les versions précédentes des lignes
+//   - soft_delete on|off : marque les lignes supprimées au lieu de les effacer
+//   - retention <durée> : conservation des lignes supprimées avant purge (30d)
+//   - ttl <durée>|off : durée de vie des lignes insérées
+//   - expires_field <champ>|off : champ datetime donnant l'expiration de la ligne
+func SetTableOption(databaseName, tableName, option, value string) error {
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	if _, ok := schema[tableName]; !ok {
+		return fmt.Errorf("la table \"%s\" n'existe pas", tableName)
+	}
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return err
+	}
+	table := settings.table(tableName)
+
+	switch option {
+	case "history":
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			return err
+		}
+		if enabled && !table.History {
+			table.History = true
+			table.HistorySince = time.Now()
+			if err := snapshotHistory(databaseName, tableName, table.HistorySince); err != nil {
+				return err
+			}
+		}
+		if !enabled {
+			table.History = false
+		}
+	case "soft_delete":
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			return err
+		}
+		table.SoftDelete = enabled
+	case "retention":
+		if _, err := ParseRetention(value); err != nil {
+			return err
+		}
+		table.Retention = value
+	case "ttl":
+		if value == "off" {
+			table.TTL = ""
+			break
+		}
+		if d, err := ParseRetention(value); err != nil || d == 0 {
+			return fmt.Errorf("durée invalide : \"%s\" (exemples : 30d, 12h)", value)
+		}
+		table.TTL = value
+	case "expires_field":
+		if value == "off" {
+			table.ExpiresField = ""
+			break
+		}
+		if fieldTypes(schema[tableName])[value] != "datetime" {
+			return fmt.Errorf("le champ \"%s\" n'est pas un champ datetime de la table \"%s\"", value, tableName)
+		}
+		table.ExpiresField = value
+	default:
+		return fmt.Errorf("option inconnue : %s", option)
+	}
+	return saveSettings(databaseName, settings)
+}
+
+// GetTableSettings retourne les options de la table (valeurs par défaut si
+// aucune n'a été définie).
+func GetTableSettings(databaseName, tableName string) (TableSettings, error) {
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return TableSettings{}, err
+	}
+	if table, ok := settings.Tables[tableName]; ok {
+		return *table, nil
+	}
+	return TableSettings{}, nil
+}
+
+// GetCacheConfig retourne la configuration du cache de la base, complétée
+// des valeurs par défaut.
+func GetCacheConfig(databaseName string) (CacheConfig, error) {
+	config := CacheConfig{
+		Enabled:    true,
+		TTL:        defaultCacheTTL,
+		MaxEntries: defaultCacheMaxEntries,
+		MaxBytes:   defaultCacheMaxBytes,
+	}
+	settings, err := loadSettings(databaseName)
+	if err != nil || settings.Cache == nil {
+		return config, err
+	}
+	cache := settings.Cache
+	config.Enabled = !cache.Disabled
+	if cache.TTL != "" {
+		if config.TTL, err = ParseRetention(cache.TTL); err != nil {
+			return config, err
+		}
+	}
+	if cache.MaxEntries > 0 {
+		config.MaxEntries = cache.MaxEntries
+	}
+	if cache.MaxBytes > 0 {
+		config.MaxBytes = cache.MaxBytes
+	}
+	return config, nil
+}
+
+// SetCacheOption modifie une option du cache de la base :
+//   - enabled on|off
+//   - ttl <durée> : durée de vie d'une entrée (0 : sans expiration)
+//   - max_entries <n> : nombre maximal d'entrées
+//   - max_bytes <taille> : taille maximale (ex. 512KB, 8MB)
+func SetCacheOption(databaseName, option, value string) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return err
+	}
+	if settings.Cache == nil {
+		settings.Cache = &CacheSettings{}
+	}
+
+	switch option {
+	case "enabled":
+		enabled, err := parseSwitch(value)
+		if err != nil {
+			return err
+		}
+		settings.Cache.Disabled = !enabled
+		if !enabled {
+			if err := clearSelectCache(databaseName); err != nil {
+				return err
+			}
+		}
+	case "ttl":
+		if _, err := ParseRetention(value); err != nil {
+			return err
+		}
+		settings.Cache.TTL = value
+	case "max_entries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("nombre d'entrées invalide : \"%s\"", value)
+		}
+		settings.Cache.MaxEntries = n
+	case "max_bytes":
+		n, err := parseSize(value)
+		if err != nil {
+			return err
+		}
+		settings.Cache.MaxBytes = n
+	default:
+		return fmt.Errorf("option inconnue : %s", option)
+	}
+	return saveSettings(databaseName, settings)
+}
+
+func GetKVConfig(databaseName string) (KVConfig, error) {
+	config := KVConfig{
+		Persistence: kvPersistenceSnapshot,
+		Fsync:       "everysec",
+		AutoRewrite: defaultKVAutoRewrite,
+	}
+	settings, err := loadSettings(databaseName)
+	if err != nil || settings.KV == nil {
+		return config, err
+	}
+	if settings.KV.Persistence != "" {
+		config.Persistence = settings.KV.Persistence
+	}
+	if settings.KV.Fsync != "" {
+		config.Fsync = settings.KV.Fsync
+	}
+	if settings.KV.AutoRewrite != nil {
+		config.AutoRewrite = *settings.KV.AutoRewrite
+	}
+	return config, nil
+}
+
+// SetKVOption modifie une option de persistance du stockage clé-valeur :
+//   - persistence snapshot|aof
+//   - fsync always|everysec|no : synchronisation du journal sur disque
+//   - auto_rewrite <taille> : taille du journal déclenchant sa réécriture
+//     dans kv.json (0 : jamais)
+func SetKVOption(databaseName, option, value string) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return err
+	}
+	if settings.KV == nil {
+		settings.KV = &KVSettings{}
+	}
+
+	switch option {
+	case "persistence":
+		if value != kvPersistenceSnapshot && value != kvPersistenceAOF {
+			return fmt.Errorf("mode de persistance invalide : \"%s\" (snapshot ou aof)", value)
+		}
+		settings.KV.Persistence = value
+	case "fsync":
+		if value != "always" && value != "everysec" && value != "no" {
+			return fmt.Errorf("valeur de fsync invalide : \"%s\" (always, everysec ou no)", value)
+		}
+		settings.KV.Fsync = value
+	case "auto_rewrite":
+		n := int64(0)
+		if value != "0" {
+			if n, err = parseSize(value); err != nil {
+				return err
+			}
+		}
+		settings.KV.AutoRewrite = &n
+	default:
+		return fmt.Errorf("option inconnue : %s", option)
+	}
+	if err := saveSettings(databaseName, settings); err != nil {
+		return err
+	}
+	// En quittant le mode aof, le journal est recopié dans kv.json.
+	if option == "persistence" && value == kvPersistenceSnapshot {
+		return KVSave(databaseName)
+	}
+	return nil
+}
+
+func parseSize(value string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("taille invalide : \"%s\" (exemples : 512KB, 8MB)", value)
+	}
+	return n * multiplier, nil
+}
+
+func (s *DatabaseSettings) table(tableName string) *TableSettings {
+	if s.Tables == nil {
+		s.Tables = map[string]*TableSettings{}
+	}
+	if _, ok := s.Tables[tableName]; !ok {
+		s.Tables[tableName] = &TableSettings{}
+	}
+	return s.Tables[tableName]
+}
+
+func parseSwitch(value string) (bool, error) {
+	switch value {
+	case "on", "true", "1":
+		return true, nil
+	case "off", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("valeur invalide : \"%s\" (on ou off attendu)", value)
+}
+
+func loadSettings(databaseName string) (*DatabaseSettings, error) {
+	settings := &DatabaseSettings{}
+	content, err := os.ReadFile(fs.GetSettingsFilePath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, nil
+		}
+		return nil, err
+	}
+	if len(content) == 0 {
+		return settings, nil
+	}
+	if err := json.Unmarshal(content, settings); err != nil {
+		return nil, fmt.Errorf("settings.json mal formé : %v", err)
+	}
+	return settings, nil
+}
+
+func saveSettings(databaseName string, settings *DatabaseSettings) error {
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fs.GetSettingsFilePath(databaseName), content, 0644)
+}
+
+// renameTableSettings et dropTableSettings suivent le renommage et la
+// suppression d'une table.
+func renameTableSettings(databaseName, oldTableName, newTableName string) error {
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return err
+	}
+	if table, ok := settings.Tables[oldTableName]; ok {
+		settings.Tables[newTableName] = table
+		delete(settings.Tables, oldTableName)
+		if err := saveSettings(databaseName, settings); err != nil {
+			return err
+		}
+	}
+	err = os.Rename(fs.GetHistoryFilePath(databaseName, oldTableName), fs.GetHistoryFilePath(databaseName, newTableName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func dropTableSettings(databaseName, tableName string) error {
+	settings, err := loadSettings(databaseName)
+	if err != nil {
+		return err
+	}
+	if _, ok := settings.Tables[tableName]; ok {
+		delete(settings.Tables, tableName)
+		if err := saveSettings(databaseName, settings); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(fs.GetHistoryFilePath(databaseName, tableName))
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// deletedAtField marque une ligne supprimée d'une table en suppression
+// logique (table set <db> <table> soft_delete on). La ligne reste dans
+// data/<table>/ mais n'est plus retournée par les sélections.
+const deletedAtField = "_deleted_at"
+
+// defaultRetention est la durée de conservation par défaut des lignes
+// supprimées avant leur purge.
+const defaultRetention = 30 * 24 * time.Hour
+
+func isDeleted(entry map[string]string) bool {
+	return entry[deletedAtField] != ""
+}
+
+// deleteRow supprime une ligne : elle est marquée si la table est en
+// suppression logique, sinon son fichier est effacé.
+func deleteRow(databaseName, tableName string, old map[string]string) error {
+	return withCommit(databaseName, func(seq int64) error {
+		return deleteRowAt(databaseName, tableName, old, seq)
+	})
+}
+
+func deleteRowAt(databaseName, tableName string, old map[string]string, seq int64) error {
+	settings, err := GetTableSettings(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	if !settings.SoftDelete {
+		return dropRowAt(databaseName, tableName, "", old, seq)
+	}
+	entry := copyRow(old)
+	entry[deletedAtField] = time.Now().Format(time.RFC3339)
+	return writeRowAt(databaseName, tableName, old, entry, seq)
+}
+
+// RestoreData restaure une ligne supprimée logiquement.
+func RestoreData(databaseName, tableName, id string) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	old, err := readRow(databaseName, tableName, id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("l'entrée avec l'id \"%s\" n'existe pas dans la table \"%s\"", id, tableName)
+		}
+		return err
+	}
+	if !isDeleted(old) {
+		return fmt.Errorf("l'entrée avec l'id \"%s\" n'est pas supprimée", id)
+	}
+	entry := copyRow(old)
+	delete(entry, deletedAtField)
+	return writeRow(databaseName, tableName, old, entry)
+}
+
+// PurgeDeleted efface définitivement les lignes supprimées depuis plus de
+// retention et retourne leurs ids.
+func PurgeDeleted(databaseName, tableName string, retention time.Duration) ([]string, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	rows, err := selectLatest(Query{DBName: databaseName, Table: tableName, IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	limit := time.Now().Add(-retention)
+	purged := []string{}
+	for _, row := range rows {
+		if !isDeleted(row) {
+			continue
+		}
+		deletedAt, err := time.Parse(time.RFC3339, row[deletedAtField])
+		if err != nil || deletedAt.After(limit) {
+			continue
+		}
+		if err := removeRow(databaseName, tableName, row); err != nil {
+			return purged, err
+		}
+		purged = append(purged, row["id"])
+	}
+	return purged, nil
+}
+
+// TableRetention retourne la durée de conservation des lignes supprimées de
+// la table (option retention, 30 jours par défaut).
+func TableRetention(databaseName, tableName string) (time.Duration, error) {
+	settings, err := GetTableSettings(databaseName, tableName)
+	if err != nil {
+		return 0, err
+	}
+	if settings.Retention == "" {
+		return defaultRetention, nil
+	}
+	return ParseRetention(settings.Retention)
+}
+
+// ParseRetention lit une durée comme "30d", "12h" ou "90m".
+func ParseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("durée invalide : \"%s\"", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("durée invalide : \"%s\" (exemples : 30d, 12h)", value)
+	}
+	return d, nil
+}
@@ -12,7 +12,10 @@ type DatabaseStats struct {
 	Name         string    `json:"name"`
 	Size         int64     `json:"size_bytes"`
 	TableCount   int       `json:"table_count"`
-	LastModified time.Time `json:"last_modified"`
+	IndexCount   int         `json:"index_count"`
+	LastModified time.Time   `json:"last_modified"`
+	Cache        *CacheStats `json:"cache,omitempty"`
+	KeyCounts    map[string]int `json:"key_counts,omitempty"`
 }
 
 type PerformanceStats struct {
@@ -95,6 +98,7 @@ func GenerateDatabaseStats(dbName string) (*DatabaseStats, error) {
 	var totalSize int64
 	var lastModified time.Time
 	var tableCount int
+	var indexCount int
 
 	err := filepath.Walk(dbPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -116,12 +120,20 @@ func GenerateDatabaseStats(dbName string) (*DatabaseStats, error) {
 	if dataFiles, err := os.ReadDir(dataPath); err == nil {
 		tableCount = len(dataFiles)
 	}
+	if indexes, err := loadIndexes(dbName, ""); err == nil {
+		indexCount = len(indexes)
+	}
+	cacheStats, _ := GetCacheStats(dbName)
+	keyCounts, _ := KVKeyCounts(dbName)
 
 	return &DatabaseStats{
 		Name:         dbName,
 		Size:         totalSize,
 		TableCount:   tableCount,
+		IndexCount:   indexCount,
 		LastModified: lastModified,
+		Cache:        cacheStats,
+		KeyCounts:    keyCounts,
 	}, nil
 }
 
@@ -102,6 +102,17 @@ func UpdateTableName(database, oldTableName, newTableName string) error {
 	newPath := filepath.Join("./../../databases", database, newTableName)
 
 	os.Rename(oldPath, newPath)
+	os.Rename(fs.GetVersionsDirPath(database, oldTableName), fs.GetVersionsDirPath(database, newTableName))
+
+	if err := renameTableIndexes(database, oldTableName, newTableName); err != nil {
+		return err
+	}
+	if err := renameTableSettings(database, oldTableName, newTableName); err != nil {
+		return err
+	}
+	if err := invalidateTables(database, oldTableName, newTableName); err != nil {
+		return err
+	}
 
 	return fs.WriteLines(path, newLines)
 }
@@ -160,6 +171,18 @@ func RemoveTable(database, tableName string) error {
 	if err := os.RemoveAll(fs.GetDataFilePath(database, tableName)); err != nil {
 		return fmt.Errorf("échec de la suppression du dossier \"%s\": %w", path, err)
 	} 
+	if err := os.RemoveAll(fs.GetVersionsDirPath(database, tableName)); err != nil {
+		return err
+	}
+	if err := dropTableIndexes(database, tableName); err != nil {
+		return err
+	}
+	if err := dropTableSettings(database, tableName); err != nil {
+		return err
+	}
+	if err := invalidateTables(database, tableName); err != nil {
+		return err
+	}
 	fmt.Printf("la table \"%s\" a été supprimée", tableName)
 	return nil
 }
@@ -0,0 +1,681 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+	"github.com/lucsky/cuid"
+)
+
+// Une transaction regroupe des écritures sur plusieurs tables. Elles restent
+// en mémoire jusqu'à Commit : les autres lecteurs ne les voient pas, et
+// Rollback ou l'arrêt du processus les abandonnent.
+//
+// Commit verrouille les tables touchées puis écrit dans txlog/<id>.json,
+// d'un bloc (fichier temporaire renommé), l'image avant (undo) et après
+// (redo) de chaque ligne : la présence du journal marque la transaction
+// comme validée. Les écritures sont ensuite appliquées et le journal
+// supprimé. Si une écriture échoue, les images avant sont réécrites ; si le
+// processus s'arrête entre-temps, RecoverTransactions rejoue les images
+// après.
+//
+// La transaction lit l'instantané pris par Begin. Commit échoue si une
+// ligne qu'elle modifie a été écrite par une autre validation depuis.
+type Tx struct {
+	ID string
+
+	databaseName string
+	schema       map[string][]string
+	snapshot     *Snapshot
+	rows         map[txKey]map[string]string
+	changes      []txChange
+	savepoints   []txSavepoint
+	done         bool
+}
+
+// txSavepoint marque la position dans changes au moment du SAVEPOINT :
+// ROLLBACK TO défait seulement les écritures suivantes.
+type txSavepoint struct {
+	name string
+	mark int
+}
+
+type txKey struct {
+	table string
+	id    string
+}
+
+// txChange est une écriture de la transaction. prev est l'état de la ligne
+// vu par la transaction avant l'écriture, touched indique si elle avait
+// déjà été écrite.
+type txChange struct {
+	key     txKey
+	prev    map[string]string
+	touched bool
+}
+
+// txLog est le contenu de txlog/<id>.json. After vaut nil pour une ligne
+// effacée, Before pour une ligne créée.
+type txLog struct {
+	ID       string    `json:"id"`
+	Database string    `json:"database"`
+	Time     time.Time `json:"time"`
+	Ops      []txLogOp `json:"ops"`
+}
+
+type txLogOp struct {
+	Table  string            `json:"table"`
+	ID     string            `json:"id"`
+	Before map[string]string `json:"before"`
+	After  map[string]string `json:"after"`
+}
+
+// Begin ouvre une transaction sur la base, après avoir terminé les
+// transactions interrompues.
+func Begin(databaseName string) (*Tx, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	if _, err := RecoverTransactions(databaseName); err != nil {
+		return nil, err
+	}
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := TakeSnapshot(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{
+		ID:           cuid.New(),
+		databaseName: databaseName,
+		schema:       schema,
+		snapshot:     snapshot,
+		rows:         map[txKey]map[string]string{},
+	}, nil
+}
+
+// Insert ajoute une ligne et retourne son id (généré s'il n'est pas fourni).
+func (tx *Tx) Insert(tableName string, row map[string]string) (string, error) {
+	types, err := tx.tableTypes(tableName)
+	if err != nil {
+		return "", err
+	}
+	entry := map[string]string{}
+	for field := range types {
+		entry[field] = row[field]
+	}
+	for field, val := range row {
+		if _, ok := types[field]; !ok {
+			return "", fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", field, tableName)
+		}
+		if err := tx.checkForeignKey(field, val); err != nil {
+			return "", err
+		}
+	}
+	if entry["id"] == "" {
+		entry["id"] = cuid.New()
+	}
+	if strings.ContainsAny(entry["id"], `/\.`) {
+		return "", fmt.Errorf("id invalide : \"%s\"", entry["id"])
+	}
+	existing, err := tx.row(tableName, entry["id"])
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("l'entrée avec l'id \"%s\" existe déjà dans la table \"%s\"", entry["id"], tableName)
+	}
+	tx.set(txKey{tableName, entry["id"]}, entry)
+	return entry["id"], nil
+}
+
+// Update modifie une ligne. Les valeurs marquées par Expr sont des
+// expressions, évaluées sur la ligne telle que la voit la transaction.
+func (tx *Tx) Update(tableName, id string, updates map[string]string) error {
+	types, err := tx.tableTypes(tableName)
+	if err != nil {
+		return err
+	}
+	old, err := tx.row(tableName, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("l'entrée avec l'id \"%s\" n'existe pas dans la table \"%s\"", id, tableName)
+	}
+	entry := copyRow(old)
+	for field, expr := range updates {
+		if field == "id" {
+			return fmt.Errorf("le champ \"id\" ne peut pas être modifié")
+		}
+		if _, ok := types[field]; !ok {
+			return fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", field, tableName)
+		}
+		val, err := evalUpdateExpr(field, expr, old, types)
+		if err != nil {
+			return fmt.Errorf("expression invalide pour \"%s\" : %v", field, err)
+		}
+		if err := tx.checkForeignKey(field, val); err != nil {
+			return err
+		}
+		entry[field] = val
+	}
+	tx.set(txKey{tableName, id}, entry)
+	return nil
+}
+
+// Delete supprime une ligne (logiquement si la table est en soft_delete).
+func (tx *Tx) Delete(tableName, id string) error {
+	if _, err := tx.tableTypes(tableName); err != nil {
+		return err
+	}
+	old, err := tx.row(tableName, id)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fmt.Errorf("l'entrée avec l'id \"%s\" n'existe pas dans la table \"%s\"", id, tableName)
+	}
+	tx.set(txKey{tableName, id}, nil)
+	return nil
+}
+
+// Get retourne une ligne telle que la voit la transaction.
+func (tx *Tx) Get(tableName, id string) (map[string]string, error) {
+	if _, err := tx.tableTypes(tableName); err != nil {
+		return nil, err
+	}
+	row, err := tx.row(tableName, id)
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		return nil, fmt.Errorf("l'entrée avec l'id \"%s\" n'existe pas dans la table \"%s\"", id, tableName)
+	}
+	return copyRow(publicRow(row)), nil
+}
+
+// Select exécute la requête en tenant compte des écritures de la
+// transaction.
+func (tx *Tx) Select(query Query) ([]map[string]string, error) {
+	if tx.done {
+		return nil, fmt.Errorf("la transaction est terminée")
+	}
+	query.DBName = tx.databaseName
+	query.snapshot = tx.snapshot
+	types, err := tx.tableTypes(query.Table)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := SelectWhere(query)
+	if err != nil {
+		return nil, err
+	}
+	results := []map[string]string{}
+	for _, row := range rows {
+		if _, touched := tx.rows[txKey{query.Table, row["id"]}]; !touched {
+			results = append(results, row)
+		}
+	}
+	for _, key := range tx.keys() {
+		row := tx.rows[key]
+		if key.table == query.Table && row != nil && matchesConditions(row, query.Conditions, types, nil) {
+			results = append(results, copyRow(publicRow(row)))
+		}
+	}
+	return results, nil
+}
+
+// Pending retourne le nombre de lignes modifiées par la transaction.
+func (tx *Tx) Pending() int {
+	return len(tx.rows)
+}
+
+// HasSavepoint indique si un point de sauvegarde est posé.
+func (tx *Tx) HasSavepoint() bool {
+	return len(tx.savepoints) > 0
+}
+
+// Savepoint pose un point de sauvegarde. Un nom déjà utilisé masque le
+// précédent jusqu'à sa libération.
+func (tx *Tx) Savepoint(name string) error {
+	if tx.done {
+		return fmt.Errorf("la transaction est terminée")
+	}
+	tx.savepoints = append(tx.savepoints, txSavepoint{name: name, mark: len(tx.changes)})
+	return nil
+}
+
+// RollbackTo défait les écritures faites depuis le point de sauvegarde, qui
+// reste posé ; les points posés après lui sont retirés.
+func (tx *Tx) RollbackTo(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	mark := tx.savepoints[i].mark
+	for j := len(tx.changes) - 1; j >= mark; j-- {
+		change := tx.changes[j]
+		if change.touched {
+			tx.rows[change.key] = change.prev
+		} else {
+			delete(tx.rows, change.key)
+		}
+	}
+	tx.changes = tx.changes[:mark]
+	tx.savepoints = tx.savepoints[:i+1]
+	return nil
+}
+
+// Release retire le point de sauvegarde et ceux posés après lui, sans
+// défaire les écritures.
+func (tx *Tx) Release(name string) error {
+	i, err := tx.findSavepoint(name)
+	if err != nil {
+		return err
+	}
+	tx.savepoints = tx.savepoints[:i]
+	return nil
+}
+
+func (tx *Tx) findSavepoint(name string) (int, error) {
+	if tx.done {
+		return 0, fmt.Errorf("la transaction est terminée")
+	}
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		if tx.savepoints[i].name == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("le point de sauvegarde \"%s\" n'existe pas", name)
+}
+
+// Rollback abandonne les écritures de la transaction.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return fmt.Errorf("la transaction est terminée")
+	}
+	tx.done = true
+	tx.snapshot.Release()
+	tx.rows, tx.changes, tx.savepoints = nil, nil, nil
+	return nil
+}
+
+// Commit applique les écritures de la transaction. En cas d'erreur, aucune
+// n'est conservée.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("la transaction est terminée")
+	}
+	tx.done = true
+	defer tx.snapshot.Release()
+	if len(tx.rows) == 0 {
+		return nil
+	}
+
+	unlock, err := lockTables(tx.databaseName, tx.tables())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	log := txLog{ID: tx.ID, Database: tx.databaseName, Time: time.Now()}
+	for _, key := range tx.keys() {
+		op, err := tx.logOp(key)
+		if err != nil {
+			return err
+		}
+		if op != nil {
+			log.Ops = append(log.Ops, *op)
+		}
+	}
+	if len(log.Ops) == 0 {
+		return nil
+	}
+	seq, end, err := beginCommit(tx.databaseName)
+	if err != nil {
+		return err
+	}
+	defer end()
+	if err := writeTxLog(tx.databaseName, log); err != nil {
+		return fmt.Errorf("impossible d'écrire le journal de transaction : %v", err)
+	}
+
+	for i, op := range log.Ops {
+		if err := applyTxImage(tx.databaseName, op.Table, op.Before, op.After, seq); err != nil {
+			if undoErr := tx.undoOps(log.Ops[:i+1], seq); undoErr != nil {
+				// Le journal est conservé : RecoverTransactions terminera la
+				// transaction en rejouant ses images après.
+				return fmt.Errorf("échec de l'écriture de \"%s\" dans \"%s\" (%v) puis de son annulation, transaction reprise par tx recover : %v", op.ID, op.Table, err, undoErr)
+			}
+			os.Remove(fs.GetTxLogFile(tx.databaseName, tx.ID))
+			return fmt.Errorf("échec de l'écriture de \"%s\" dans \"%s\", transaction annulée : %v", op.ID, op.Table, err)
+		}
+	}
+	return os.Remove(fs.GetTxLogFile(tx.databaseName, tx.ID))
+}
+
+// undoOps réécrit les images avant des opérations, de la dernière à la
+// première, et s'arrête à la première erreur.
+func (tx *Tx) undoOps(ops []txLogOp, seq int64) error {
+	for j := len(ops) - 1; j >= 0; j-- {
+		undo := ops[j]
+		current, err := readRow(tx.databaseName, undo.Table, undo.ID)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			current = nil
+		}
+		if err := applyTxImage(tx.databaseName, undo.Table, current, undo.Before, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverTransactions termine les transactions validées dont l'application
+// a été interrompue, en rejouant leurs images après, et retourne leur
+// nombre.
+func RecoverTransactions(databaseName string) (int, error) {
+	dir := fs.GetTxLogDirPath(databaseName)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	recovered := 0
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			// Journal incomplet : la transaction n'a pas été validée. Un
+			// journal récent peut être en cours d'écriture par un autre
+			// processus.
+			if info, err := file.Info(); err == nil && time.Since(info.ModTime()) > lockStaleAfter {
+				os.Remove(path)
+			}
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return recovered, err
+		}
+		var log txLog
+		if err := json.Unmarshal(content, &log); err != nil {
+			return recovered, fmt.Errorf("journal de transaction %s illisible : %v", file.Name(), err)
+		}
+		redone, err := redoTxLog(databaseName, path, log)
+		if err != nil {
+			return recovered, err
+		}
+		if redone {
+			recovered++
+		}
+	}
+	return recovered, nil
+}
+
+// redoTxLog rejoue le journal path puis le supprime. Le journal d'une
+// transaction en cours d'application disparaît avant que ses verrous ne
+// soient libérés : s'il n'existe plus une fois les tables verrouillées, il
+// n'y a rien à reprendre.
+func redoTxLog(databaseName, path string, log txLog) (bool, error) {
+	tables := []string{}
+	for _, op := range log.Ops {
+		tables = append(tables, op.Table)
+	}
+	unlock, err := lockTables(databaseName, tables)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	err = withCommit(databaseName, func(seq int64) error {
+		for _, op := range log.Ops {
+			current, err := readRow(databaseName, op.Table, op.ID)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := applyTxImage(databaseName, op.Table, current, op.After, seq); err != nil {
+				return fmt.Errorf("échec de la reprise de la transaction %s : %v", log.ID, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// applyTxImage remplace la ligne current par target : création, réécriture
+// ou effacement (target nil). Rien n'est écrit si la ligne est déjà dans
+// l'état voulu.
+func applyTxImage(databaseName, tableName string, current, target map[string]string, seq int64) error {
+	if target == nil {
+		if current == nil {
+			return nil
+		}
+		return dropRowAt(databaseName, tableName, "", current, seq)
+	}
+	if sameRow(current, target) {
+		return nil
+	}
+	if err := os.MkdirAll(fs.GetDataFilePath(databaseName, tableName), 0755); err != nil {
+		return err
+	}
+	return writeImageAt(databaseName, tableName, current, copyRow(target), seq)
+}
+
+// logOp calcule les images avant et après d'une ligne modifiée, nil si la
+// ligne n'est finalement pas modifiée. La ligne ne doit pas avoir changé
+// depuis l'instantané de la transaction.
+func (tx *Tx) logOp(key txKey) (*txLogOp, error) {
+	before, err := readRow(tx.databaseName, key.table, key.id)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		before = nil
+	}
+	seen, err := tx.snapshot.resolve(key.table, key.id, before)
+	if err != nil {
+		return nil, err
+	}
+	if (seen != nil || before != nil) && !sameRow(seen, before) {
+		return nil, fmt.Errorf("conflit d'écriture : l'entrée \"%s\" de la table \"%s\" a été modifiée par une autre transaction", key.id, key.table)
+	}
+	after := tx.rows[key]
+	if after == nil && before != nil && !isDeleted(before) {
+		settings, err := GetTableSettings(tx.databaseName, key.table)
+		if err != nil {
+			return nil, err
+		}
+		if settings.SoftDelete {
+			after = copyRow(before)
+			after[deletedAtField] = time.Now().Format(time.RFC3339)
+		}
+	}
+	if after == nil && (before == nil || isDeleted(before)) {
+		return nil, nil
+	}
+	if after != nil {
+		// La version est fixée dans le journal pour qu'un rejeu réécrive
+		// exactement la même ligne.
+		after = copyRow(after)
+		stampVersion(before, after)
+	}
+	return &txLogOp{Table: key.table, ID: key.id, Before: before, After: after}, nil
+}
+
+// row retourne la ligne telle que la voit la transaction, nil si elle
+// n'existe pas (ou est supprimée, ou a expiré).
+func (tx *Tx) row(tableName, id string) (map[string]string, error) {
+	if tx.done {
+		return nil, fmt.Errorf("la transaction est terminée")
+	}
+	if row, touched := tx.rows[txKey{tableName, id}]; touched {
+		return row, nil
+	}
+	row, err := readRow(tx.databaseName, tableName, id)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if row, err = tx.snapshot.resolve(tableName, id, row); err != nil || row == nil {
+		return nil, err
+	}
+	expired, err := isRowExpired(tx.databaseName, tableName, row)
+	if err != nil {
+		return nil, err
+	}
+	if isDeleted(row) || expired {
+		return nil, nil
+	}
+	return row, nil
+}
+
+func (tx *Tx) set(key txKey, row map[string]string) {
+	prev, touched := tx.rows[key]
+	tx.changes = append(tx.changes, txChange{key: key, prev: prev, touched: touched})
+	tx.rows[key] = row
+}
+
+// keys retourne les lignes modifiées dans l'ordre de leur première
+// écriture.
+func (tx *Tx) keys() []txKey {
+	seen := map[txKey]bool{}
+	keys := []txKey{}
+	for _, change := range tx.changes {
+		if _, ok := tx.rows[change.key]; ok && !seen[change.key] {
+			seen[change.key] = true
+			keys = append(keys, change.key)
+		}
+	}
+	return keys
+}
+
+func (tx *Tx) tables() []string {
+	tables := []string{}
+	for key := range tx.rows {
+		tables = append(tables, key.table)
+	}
+	return tables
+}
+
+func (tx *Tx) tableTypes(tableName string) (map[string]string, error) {
+	if tx.done {
+		return nil, fmt.Errorf("la transaction est terminée")
+	}
+	fields, ok := tx.schema[tableName]
+	if !ok {
+		return nil, fmt.Errorf("la table \"%s\" n'existe pas", tableName)
+	}
+	return fieldTypes(fields), nil
+}
+
+// checkForeignKey accepte aussi une ligne liée insérée par la transaction.
+func (tx *Tx) checkForeignKey(field, val string) error {
+	if !strings.HasSuffix(field, "_id") || val == "" {
+		return nil
+	}
+	if row, touched := tx.rows[txKey{strings.TrimSuffix(field, "_id"), val}]; touched {
+		if row == nil {
+			return fmt.Errorf("la valeur \"%s\" pour \"%s\" a été supprimée par la transaction", val, field)
+		}
+		return nil
+	}
+	return checkForeignKey(tx.databaseName, field, val)
+}
+
+func writeTxLog(databaseName string, log txLog) error {
+	if err := os.MkdirAll(fs.GetTxLogDirPath(databaseName), 0755); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(log, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := fs.GetTxLogFile(databaseName, log.ID)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// lockTables prend les verrous de plusieurs tables, toujours dans le même
+// ordre pour éviter les interblocages.
+func lockTables(databaseName string, tables []string) (func(), error) {
+	sort.Strings(tables)
+	unlocks := []func(){}
+	release := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for i, table := range tables {
+		if i > 0 && table == tables[i-1] {
+			continue
+		}
+		unlock, err := lockTable(databaseName, table)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return release, nil
+}
+
+// sameRow compare deux lignes, hors numéro de validation.
+func sameRow(a, b map[string]string) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	for field, val := range a {
+		if other, ok := b[field]; field != xminField && (!ok || other != val) {
+			return false
+		}
+	}
+	for field := range b {
+		if _, ok := a[field]; field != xminField && !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"github.com/fabian222222/lib-db/pkg/fs"
+	"github.com/lucsky/cuid"
+)
+
+// UpsertOptions décrit le comportement d'UpsertData en cas de conflit.
+// Sans ConflictFields, le conflit porte sur "id" s'il est fourni. Sinon, il
+// porte sur les champs unique présents dans la ligne, vérifiés chacun
+// séparément. Les champs donnés dans ConflictFields forment au contraire une
+// clé composite. Avec UpdateColumns vide, toutes les colonnes fournies sont
+// mises à jour, sauf les champs de conflit.
+type UpsertOptions struct {
+	ConflictFields []string
+	DoNothing      bool
+	UpdateColumns  []string
+}
+
+// UpsertData insère row ou, si une ligne existe déjà avec les mêmes valeurs
+// pour les champs de conflit, la met à jour (ON CONFLICT DO UPDATE) ou la
+// laisse intacte (ON CONFLICT DO NOTHING). Retourne l'action effectuée
+// ("inserted", "updated" ou "ignored") et l'id de la ligne.
+func UpsertData(databaseName, tableName string, row map[string]string, opts UpsertOptions) (string, string, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return "", "", fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return "", "", err
+	}
+	fields, ok := schema[tableName]
+	if !ok {
+		return "", "", fmt.Errorf("la table \"%s\" n'existe pas", tableName)
+	}
+	types := fieldTypes(fields)
+	// L'insertion et la recherche de conflit prennent les valeurs telles
+	// quelles ; les expressions ne sont évaluées qu'à la mise à jour.
+	literal := map[string]string{}
+	for field, val := range row {
+		if _, ok := types[field]; !ok {
+			return "", "", fmt.Errorf("le champ \"%s\" n'existe pas dans la table \"%s\"", field, tableName)
+		}
+		literal[field] = literalValue(val)
+		if err := checkForeignKey(databaseName, field, literal[field]); err != nil {
+			return "", "", err
+		}
+	}
+	if id := literal["id"]; strings.ContainsAny(id, `/\.`) {
+		return "", "", fmt.Errorf("id invalide : \"%s\"", id)
+	}
+
+	conflictFields := opts.ConflictFields
+	separate := false
+	if len(conflictFields) == 0 {
+		conflictFields = defaultConflictFields(fields, row)
+		separate = len(conflictFields) > 0 && conflictFields[0] != "id"
+	}
+	if len(conflictFields) == 0 {
+		return "", "", fmt.Errorf("aucun champ de conflit : fournissez l'id ou un champ unique")
+	}
+	for _, field := range conflictFields {
+		if _, ok := row[field]; !ok {
+			return "", "", fmt.Errorf("le champ de conflit \"%s\" doit être fourni", field)
+		}
+	}
+
+	unlock, err := lockTable(databaseName, tableName)
+	if err != nil {
+		return "", "", err
+	}
+	defer unlock()
+
+	existing, err := findConflict(databaseName, tableName, conflictFields, separate, literal)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Une ligne supprimée logiquement ou expirée avec le même id est
+	// remplacée.
+	var replaced map[string]string
+	if existing != nil {
+		expired, err := isRowExpired(databaseName, tableName, existing)
+		if err != nil {
+			return "", "", err
+		}
+		if expired || isDeleted(existing) {
+			replaced, existing = existing, nil
+		}
+	}
+
+	if existing == nil {
+		entry := map[string]string{}
+		for field := range types {
+			entry[field] = literal[field]
+		}
+		if entry["id"] == "" {
+			entry["id"] = cuid.New()
+		}
+		if err := os.MkdirAll(fs.GetDataFilePath(databaseName, tableName), 0755); err != nil {
+			return "", "", fmt.Errorf("échec création dossier pour table : %w", err)
+		}
+		SaveQueryToCache(CachedQuery{
+			Action: "insert",
+			DBName: databaseName,
+			Table:  tableName,
+			Data:   entry,
+		})
+		if err := writeRow(databaseName, tableName, replaced, entry); err != nil {
+			return "", "", err
+		}
+		return "inserted", entry["id"], ClearCacheFile(databaseName)
+	}
+
+	if opts.DoNothing {
+		return "ignored", existing["id"], nil
+	}
+
+	columns := opts.UpdateColumns
+	if len(columns) == 0 {
+		for field := range row {
+			// Les champs uniques vérifiés séparément ne désignent pas tous
+			// la ligne : ceux qui diffèrent sont mis à jour.
+			if separate || !containsString(conflictFields, field) {
+				columns = append(columns, field)
+			}
+		}
+	}
+	entry := copyRow(existing)
+	for _, field := range columns {
+		if field == "id" {
+			continue
+		}
+		expr, ok := row[field]
+		if !ok {
+			return "", "", fmt.Errorf("le champ \"%s\" à mettre à jour n'est pas fourni", field)
+		}
+		val, err := evalUpdateExpr(field, expr, existing, types)
+		if err != nil {
+			return "", "", fmt.Errorf("expression invalide pour \"%s\" : %v", field, err)
+		}
+		if err := checkForeignKey(databaseName, field, val); err != nil {
+			return "", "", err
+		}
+		entry[field] = val
+	}
+
+	SaveQueryToCache(CachedQuery{
+		Action: "update",
+		DBName: databaseName,
+		Table:  tableName,
+		Data:   entry,
+	})
+	if err := writeRow(databaseName, tableName, existing, entry); err != nil {
+		return "", "", err
+	}
+	return "updated", entry["id"], ClearCacheFile(databaseName)
+}
+
+func defaultConflictFields(fields []string, row map[string]string) []string {
+	if _, ok := row["id"]; ok {
+		return []string{"id"}
+	}
+	conflictFields := []string{}
+	for _, field := range fields {
+		parts := strings.Split(field, ":")
+		if len(parts) < 3 || !containsString(strings.Split(parts[2], ","), "unique") {
+			continue
+		}
+		if _, ok := row[parts[0]]; ok {
+			conflictFields = append(conflictFields, parts[0])
+		}
+	}
+	return conflictFields
+}
+
+// findConflict retourne la ligne en conflit avec row, nil s'il n'y en a pas.
+// Avec separate, chaque champ unique est cherché seul : une ligne qui a le
+// même email mais pas le même username est en conflit, et des champs qui
+// désignent des lignes différentes sont une erreur.
+func findConflict(databaseName, tableName string, conflictFields []string, separate bool, row map[string]string) (map[string]string, error) {
+	if len(conflictFields) == 1 && conflictFields[0] == "id" {
+		existing, err := readRow(databaseName, tableName, row["id"])
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return existing, err
+	}
+	if separate {
+		var existing map[string]string
+		for _, field := range conflictFields {
+			match, err := findConflict(databaseName, tableName, []string{field}, false, row)
+			if err != nil {
+				return nil, err
+			}
+			if match == nil {
+				continue
+			}
+			if existing != nil && existing["id"] != match["id"] {
+				return nil, fmt.Errorf("les champs uniques %s correspondent à des lignes différentes", strings.Join(conflictFields, ","))
+			}
+			existing = match
+		}
+		return existing, nil
+	}
+
+	conditions := []Condition{}
+	for _, field := range conflictFields {
+		conditions = append(conditions, Condition{Field: field, Op: "=", Value: row[field]})
+	}
+	matches, err := selectLatest(Query{DBName: databaseName, Table: tableName, Conditions: conditions})
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%d lignes correspondent aux champs de conflit %s", len(matches), strings.Join(conflictFields, ","))
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0], nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
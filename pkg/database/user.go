@@ -53,6 +53,16 @@ func ClearSession() error {
 }
 
 func Authenticate(username, password string) (bool, *User, error) {
+	ok, user, err := CheckCredentials(username, password)
+	if ok {
+		SaveSession(username)
+	}
+	return ok, user, err
+}
+
+// CheckCredentials vérifie un mot de passe sans ouvrir de session, pour les
+// connexions du serveur Redis.
+func CheckCredentials(username, password string) (bool, *User, error) {
 	users, err := LoadUsers()
 	if err != nil {
 		return false, nil, err
@@ -61,7 +71,6 @@ func Authenticate(username, password string) (bool, *User, error) {
 	for _, u := range users {
 		if u.Username == username {
 			if CheckPasswordHash(password, u.Password) {
-				SaveSession(username)
 				return true, &u, nil
 			}
 			return false, nil, nil
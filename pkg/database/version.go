@@ -0,0 +1,46 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Chaque ligne porte un numéro de version (_version), incrémenté à chaque
+// écriture, et la date de sa dernière modification (_updated_at). Une mise à
+// jour ou une suppression peut exiger la version lue par l'utilisateur
+// (verrouillage optimiste) : elle échoue si quelqu'un a écrit la ligne
+// entre-temps.
+const (
+	versionField   = "_version"
+	updatedAtField = "_updated_at"
+)
+
+// stampVersion donne à entry une version supérieure à celle de old et à
+// celle qu'elle porte déjà : la version ne recule jamais, même si entry a
+// été lue avant une autre écriture. Seules les images exactes (voir
+// writeImageAt) gardent leur version.
+func stampVersion(old, entry map[string]string) {
+	version := rowVersion(old)
+	if v := rowVersion(entry); v > version {
+		version = v
+	}
+	entry[versionField] = strconv.FormatInt(version+1, 10)
+	entry[updatedAtField] = time.Now().Format(time.RFC3339)
+}
+
+// rowVersion retourne la version de la ligne, 0 pour une ligne absente ou
+// écrite avant l'ajout des versions.
+func rowVersion(row map[string]string) int64 {
+	version, _ := strconv.ParseInt(row[versionField], 10, 64)
+	return version
+}
+
+// checkVersion vérifie que la ligne est dans la version attendue. 0 désactive
+// la vérification.
+func checkVersion(row map[string]string, expected int64) error {
+	if expected == 0 || rowVersion(row) == expected {
+		return nil
+	}
+	return fmt.Errorf("conflit de version : l'entrée \"%s\" est en version %d, version %d attendue", row["id"], rowVersion(row), expected)
+}
@@ -0,0 +1,231 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"github.com/fabian222222/lib-db/pkg/fs"
+)
+
+// View est une requête nommée sur une table. Une vue matérialisée garde le
+// résultat de sa requête dans views/<nom>.json ; avec AutoRefresh, ce
+// résultat est recalculé à la première lecture qui suit une écriture dans la
+// table de base. Generation retient la génération de la table de base (voir
+// invalidateTables) au dernier rafraîchissement.
+type View struct {
+	Name         string      `json:"name"`
+	Table        string      `json:"table"`
+	Conditions   []Condition `json:"conditions"`
+	Materialized bool        `json:"materialized"`
+	AutoRefresh  bool        `json:"auto_refresh"`
+	RefreshedAt  time.Time   `json:"refreshed_at,omitempty"`
+	Generation   int64       `json:"generation,omitempty"`
+}
+
+func CreateView(databaseName, viewName string, query Query, materialized, autoRefresh bool) error {
+	if !fs.DoesDirExist(databaseName) {
+		return fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	schema, err := loadSchema(databaseName)
+	if err != nil {
+		return err
+	}
+	if _, ok := schema[viewName]; ok {
+		return fmt.Errorf("une table s'appelle déjà \"%s\"", viewName)
+	}
+	if _, ok := schema[query.Table]; !ok {
+		return fmt.Errorf("la table \"%s\" n'existe pas", query.Table)
+	}
+
+	views, err := loadViews(databaseName)
+	if err != nil {
+		return err
+	}
+	for _, view := range views {
+		if view.Name == viewName {
+			return fmt.Errorf("la vue \"%s\" existe déjà", viewName)
+		}
+	}
+
+	query.DBName = databaseName
+	if _, err := PlanQuery(query); err != nil {
+		return err
+	}
+
+	view := View{
+		Name:         viewName,
+		Table:        query.Table,
+		Conditions:   query.Conditions,
+		Materialized: materialized,
+		AutoRefresh:  materialized && autoRefresh,
+	}
+	views = append(views, view)
+	if err := saveViews(databaseName, views); err != nil {
+		return err
+	}
+	if materialized {
+		return RefreshView(databaseName, viewName)
+	}
+	return nil
+}
+
+func DropView(databaseName, viewName string) error {
+	views, err := loadViews(databaseName)
+	if err != nil {
+		return err
+	}
+	kept := []View{}
+	found := false
+	for _, view := range views {
+		if view.Name == viewName {
+			found = true
+			continue
+		}
+		kept = append(kept, view)
+	}
+	if !found {
+		return fmt.Errorf("la vue \"%s\" n'existe pas", viewName)
+	}
+	if err := os.Remove(fs.GetViewDataFile(databaseName, viewName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := saveViews(databaseName, kept); err != nil {
+		return err
+	}
+	return invalidateTables(databaseName, viewName)
+}
+
+func ListViews(databaseName string) ([]View, error) {
+	if !fs.DoesDirExist(databaseName) {
+		return nil, fmt.Errorf("la base de données \"%s\" n'existe pas", databaseName)
+	}
+	return loadViews(databaseName)
+}
+
+// RefreshView recalcule et enregistre le résultat d'une vue matérialisée.
+func RefreshView(databaseName, viewName string) error {
+	views, err := loadViews(databaseName)
+	if err != nil {
+		return err
+	}
+	for i, view := range views {
+		if view.Name != viewName {
+			continue
+		}
+		if !view.Materialized {
+			return fmt.Errorf("la vue \"%s\" n'est pas matérialisée", viewName)
+		}
+
+		// La génération est lue avant la table : une écriture concurrente
+		// laisse la vue périmée et elle sera recalculée à la lecture suivante.
+		generations, err := tableGenerations(databaseName, []string{view.Table})
+		if err != nil {
+			return err
+		}
+		rows, err := selectLatest(Query{DBName: databaseName, Table: view.Table, Conditions: view.Conditions})
+		if err != nil {
+			return err
+		}
+		content, err := json.MarshalIndent(rows, "", "  ")
+		if err != nil {
+			return err
+		}
+		path := fs.GetViewDataFile(databaseName, viewName)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+
+		views[i].RefreshedAt = time.Now()
+		views[i].Generation = generations[view.Table]
+		if err := saveViews(databaseName, views); err != nil {
+			return err
+		}
+		return invalidateTables(databaseName, viewName)
+	}
+	return fmt.Errorf("la vue \"%s\" n'existe pas", viewName)
+}
+
+func findView(databaseName, name string) (*View, error) {
+	views, err := loadViews(databaseName)
+	if err != nil {
+		return nil, err
+	}
+	for _, view := range views {
+		if view.Name == name {
+			return &view, nil
+		}
+	}
+	return nil, nil
+}
+
+// expand réécrit une requête sur la vue en requête sur sa table de base.
+func (v *View) expand(query Query) Query {
+	conditions := append([]Condition{}, v.Conditions...)
+	return Query{
+		DBName:         query.DBName,
+		Table:          v.Table,
+		Conditions:     append(conditions, query.Conditions...),
+		IncludeDeleted: query.IncludeDeleted,
+	}
+}
+
+// readMaterialized lit le résultat enregistré d'une vue matérialisée.
+func readMaterialized(databaseName string, view *View) ([]map[string]string, error) {
+	content, err := os.ReadFile(fs.GetViewDataFile(databaseName, view.Name))
+	if err != nil {
+		return nil, fmt.Errorf("la vue \"%s\" n'a pas encore été rafraîchie : %v", view.Name, err)
+	}
+	var rows []map[string]string
+	if err := json.Unmarshal(content, &rows); err != nil {
+		return nil, fmt.Errorf("vue \"%s\" mal formée : %v", view.Name, err)
+	}
+	return rows, nil
+}
+
+// refreshIfStale rafraîchit une vue en AutoRefresh dont la table de base a
+// été modifiée depuis son dernier rafraîchissement. Une opération groupée ne
+// coûte ainsi qu'un recalcul, fait à la lecture plutôt qu'à chaque ligne.
+func refreshIfStale(databaseName string, view *View) error {
+	if !view.Materialized || !view.AutoRefresh {
+		return nil
+	}
+	generations, err := tableGenerations(databaseName, []string{view.Table})
+	if err != nil {
+		return err
+	}
+	if generations[view.Table] == view.Generation {
+		return nil
+	}
+	return RefreshView(databaseName, view.Name)
+}
+
+func loadViews(databaseName string) ([]View, error) {
+	content, err := os.ReadFile(fs.GetViewsFilePath(databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []View{}, nil
+		}
+		return nil, err
+	}
+	var views []View
+	if len(content) == 0 {
+		return []View{}, nil
+	}
+	if err := json.Unmarshal(content, &views); err != nil {
+		return nil, fmt.Errorf("views.json mal formé : %v", err)
+	}
+	return views, nil
+}
+
+func saveViews(databaseName string, views []View) error {
+	content, err := json.MarshalIndent(views, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fs.GetViewsFilePath(databaseName), content, 0644)
+}
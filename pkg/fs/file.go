@@ -21,7 +21,7 @@ func CreateFile(databaseName string, fileName string) error {
 	path := "./../../databases/" + databaseName + "/" + fileName
 	_, err := os.Stat(path)
 	if err == nil {
-		return fmt.Errorf("file arealdy exist", path)
+		return fmt.Errorf("file %s already exists", path)
 	}
 	if !os.IsNotExist(err) {
 		return err
@@ -55,10 +55,86 @@ func GetCacheFilePath(database string) string {
 	return filepath.Join("./../../databases", database, "cache.txt")
 }
 
+func GetCacheDirPath(database string) string {
+	return filepath.Join("./../../databases", database, "cache")
+}
+
+func GetCacheEntryFile(database string, key string) string {
+	return filepath.Join("./../../databases", database, "cache", key + ".json")
+}
+
+func GetCacheStatsFilePath(database string) string {
+	return filepath.Join("./../../databases", database, "cache_stats.json")
+}
+
 func GetPendingFilePath(database string) string {
 	return filepath.Join("./../../databases", database, "pending.txt")
 }
 
+func GetIndexDirPath(database string) string {
+	return filepath.Join("./../../databases", database, "indexes")
+}
+
+func GetIndexFilePath(database string, tableName string, fieldName string) string {
+	return filepath.Join("./../../databases", database, "indexes", tableName + "." + fieldName + ".json")
+}
+
+func GetViewsFilePath(database string) string {
+	return filepath.Join("./../../databases", database, "views.json")
+}
+
+func GetViewDataFile(database string, viewName string) string {
+	return filepath.Join("./../../databases", database, "views", viewName + ".json")
+}
+
+func GetGenerationsFilePath(database string) string {
+	return filepath.Join("./../../databases", database, "generations.json")
+}
+
+func GetSettingsFilePath(database string) string {
+	return filepath.Join("./../../databases", database, "settings.json")
+}
+
+func GetHistoryFilePath(database string, tableName string) string {
+	return filepath.Join("./../../databases", database, "history", tableName)
+}
+
+func GetHistoryFile(database string, tableName string, id string) string {
+	return filepath.Join("./../../databases", database, "history", tableName, id + ".json")
+}
+
+func GetKVFilePath(database string) string {
+	return filepath.Join("./../../databases", database, "kv.json")
+}
+
+func GetKVAOFPath(database string) string {
+	return filepath.Join("./../../databases", database, "kv.aof")
+}
+
+func GetPubSubLogPath(database string) string {
+	return filepath.Join("./../../databases", database, "pubsub.log")
+}
+
+func GetTxLogDirPath(database string) string {
+	return filepath.Join("./../../databases", database, "txlog")
+}
+
+func GetTxLogFile(database string, txID string) string {
+	return filepath.Join("./../../databases", database, "txlog", txID + ".json")
+}
+
+func GetMVCCDirPath(database string) string {
+	return filepath.Join("./../../databases", database, "mvcc")
+}
+
+func GetVersionsDirPath(database string, tableName string) string {
+	return filepath.Join("./../../databases", database, "mvcc", "versions", tableName)
+}
+
+func GetVersionsFile(database string, tableName string, id string) string {
+	return filepath.Join("./../../databases", database, "mvcc", "versions", tableName, id + ".json")
+}
+
 func DoesDataFileExist(database string, tableName string, id string) bool {
 	return DoesFileExist(GetDataFile(database, tableName, id))
 }
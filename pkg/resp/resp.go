@@ -0,0 +1,298 @@
+// Package resp lit et écrit le protocole RESP de Redis (versions 2 et 3).
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxBulkLength   = 512 << 20
+	maxArrayLength  = 1 << 20
+	maxInlineLength = 64 << 10
+
+	// Limites tant que le client ne s'est pas authentifié, comme Redis :
+	// une commande AUTH ou HELLO tient largement dedans.
+	maxUnauthBulkLength  = 16 << 10
+	maxUnauthArrayLength = 10
+)
+
+var ErrProtocol = errors.New("erreur de protocole")
+
+// SimpleString est envoyé tel quel (+OK) plutôt que comme chaîne binaire.
+type SimpleString string
+
+// Error est une réponse d'erreur ; son premier mot est le code (ERR,
+// WRONGTYPE, NOAUTH...).
+type Error string
+
+// Map est une suite de clés et de valeurs alternées, envoyée comme map en
+// RESP3 et comme tableau à plat en RESP2.
+type Map []any
+
+// Set est envoyé comme ensemble en RESP3 et comme tableau en RESP2.
+type Set []any
+
+// Push est un message poussé par le serveur (pub/sub), envoyé comme tableau
+// en RESP2.
+type Push []any
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Errorf construit une erreur ERR.
+func Errorf(format string, args ...any) Error {
+	return Error("ERR " + fmt.Sprintf(format, args...))
+}
+
+type Reader struct {
+	r             *bufio.Reader
+	authenticated bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// SetAuthenticated lève les limites de taille réduites appliquées avant
+// l'authentification du client.
+func (r *Reader) SetAuthenticated(ok bool) {
+	r.authenticated = ok
+}
+
+// ReadCommand lit une commande envoyée comme tableau de chaînes, ou en
+// ligne (« inline ») comme le fait telnet.
+func (r *Reader) ReadCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return []string{}, nil
+	}
+	if line[0] != '*' {
+		return splitInline(line)
+	}
+
+	maxArray, maxBulk := maxArrayLength, maxBulkLength
+	if !r.authenticated {
+		maxArray, maxBulk = maxUnauthArrayLength, maxUnauthBulkLength
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArray {
+		return nil, fmt.Errorf("%w : taille de tableau invalide", ErrProtocol)
+	}
+	args := make([]string, 0, min(max(n, 0), 64))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w : chaîne attendue, reçu \"%s\"", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, fmt.Errorf("%w : taille de chaîne invalide", ErrProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w : fin de chaîne attendue", ErrProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine lit une ligne d'au plus maxInlineLength octets.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength+2 {
+			return "", fmt.Errorf("%w : ligne trop longue", ErrProtocol)
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// splitInline découpe une commande en ligne ; les guillemets doubles ou
+// simples regroupent un argument.
+func splitInline(line string) ([]string, error) {
+	args := []string{}
+	var current strings.Builder
+	inArg := false
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteByte(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("%w : guillemet non fermé", ErrProtocol)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// Writer encode les réponses dans la version du protocole négociée par
+// HELLO (2 par défaut).
+type Writer struct {
+	w        *bufio.Writer
+	Protocol int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), Protocol: 2}
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Write encode une valeur : nil, string (chaîne binaire), SimpleString,
+// Error, error, entiers, float64, bool, []string, []any, Map, Set ou Push.
+func (w *Writer) Write(v any) error {
+	switch v := v.(type) {
+	case nil:
+		if w.Protocol >= 3 {
+			return w.line("_")
+		}
+		return w.line("$-1")
+	case SimpleString:
+		return w.line("+" + strings.NewReplacer("\r", " ", "\n", " ").Replace(string(v)))
+	case Error:
+		return w.line("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(string(v)))
+	case error:
+		return w.Write(Errorf("%s", v.Error()))
+	case string:
+		return w.bulk(v)
+	case int:
+		return w.line(":" + strconv.Itoa(v))
+	case int64:
+		return w.line(":" + strconv.FormatInt(v, 10))
+	case float64:
+		if w.Protocol < 3 {
+			return w.bulk(formatDouble(v))
+		}
+		return w.line("," + formatDouble(v))
+	case bool:
+		if w.Protocol >= 3 {
+			if v {
+				return w.line("#t")
+			}
+			return w.line("#f")
+		}
+		if v {
+			return w.line(":1")
+		}
+		return w.line(":0")
+	case []string:
+		if err := w.line("*" + strconv.Itoa(len(v))); err != nil {
+			return err
+		}
+		for _, s := range v {
+			if err := w.bulk(s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		return w.aggregate("*", v)
+	case Map:
+		if w.Protocol >= 3 {
+			return w.aggregate("%", v, len(v)/2)
+		}
+		return w.aggregate("*", v)
+	case Set:
+		if w.Protocol >= 3 {
+			return w.aggregate("~", v)
+		}
+		return w.aggregate("*", v)
+	case Push:
+		if w.Protocol >= 3 {
+			return w.aggregate(">", v)
+		}
+		return w.aggregate("*", v)
+	default:
+		return fmt.Errorf("type de réponse non pris en charge : %T", v)
+	}
+}
+
+func (w *Writer) aggregate(prefix string, items []any, size ...int) error {
+	n := len(items)
+	if len(size) > 0 {
+		n = size[0]
+	}
+	if err := w.line(prefix + strconv.Itoa(n)); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := w.Write(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) bulk(s string) error {
+	if err := w.line("$" + strconv.Itoa(len(s))); err != nil {
+		return err
+	}
+	return w.line(s)
+}
+
+func (w *Writer) line(s string) error {
+	if _, err := w.w.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString("\r\n")
+	return err
+}
+
+func formatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}